@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bdavs3/worker/server/auth"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+func main() {
+	app := &cli.App{
+		Name:  "worker-admin",
+		Usage: "manage the users of the worker server (send the server SIGHUP to apply changes)",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "file",
+				Aliases:  []string{"f"},
+				EnvVars:  []string{"users_file"},
+				Usage:    "user file of the server",
+				Required: true,
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "useradd",
+				Usage:     "create a user, reading their password from the terminal or stdin",
+				ArgsUsage: "<username>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "role",
+						Value: string(auth.DefaultRole),
+						Usage: "role of the user: admin, operator or viewer",
+					},
+					&cli.StringSliceFlag{
+						Name:  "group",
+						Usage: "add the user to this group, which jobs may be shared with",
+					},
+				},
+				Action: useradd,
+			},
+			{
+				Name:      "passwd",
+				Usage:     "change the password of a user, reading it from the terminal or stdin",
+				ArgsUsage: "<username>",
+				Action:    passwd,
+			},
+			{
+				Name:      "disable",
+				Usage:     "prevent a user from authenticating",
+				ArgsUsage: "<username>",
+				Action: func(ctx *cli.Context) error {
+					return setDisabled(ctx, true)
+				},
+			},
+			{
+				Name:      "enable",
+				Usage:     "allow a disabled user to authenticate again",
+				ArgsUsage: "<username>",
+				Action: func(ctx *cli.Context) error {
+					return setDisabled(ctx, false)
+				},
+			},
+			{
+				Name:      "role",
+				Usage:     "assign a role to a user: admin (any job), operator (runs jobs) or viewer (reads jobs)",
+				ArgsUsage: "<username> <role>",
+				Action:    role,
+			},
+			{
+				Name:      "groups",
+				Usage:     "set the groups a user is a member of, which jobs may be shared with (none to clear them)",
+				ArgsUsage: "<username> [group...]",
+				Action:    groups,
+			},
+			{
+				Name:   "users",
+				Usage:  "list the users",
+				Action: users,
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openUserFile loads the user file given to the command, or creates an empty one if
+// create is true and it does not exist yet.
+func openUserFile(ctx *cli.Context, create bool) (*auth.UserFile, error) {
+	path := ctx.String("file")
+
+	userFile, err := auth.LoadUserFile(path)
+	if os.IsNotExist(err) && create {
+		return auth.NewUserFile(path), nil
+	}
+
+	return userFile, err
+}
+
+func useradd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("no username supplied to 'useradd' command")
+	}
+
+	username := ctx.Args().Get(0)
+	err := auth.ValidateUsername(username)
+	if err != nil {
+		return err
+	}
+	role, err := auth.ParseRole(ctx.String("role"))
+	if err != nil {
+		return err
+	}
+
+	userFile, err := openUserFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := userFile.Lookup(username); ok {
+		return fmt.Errorf("user %s already exists", username)
+	}
+
+	hash, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	err = userFile.SetUser(auth.User{Name: username, Hash: hash, Role: role, Groups: ctx.StringSlice("group")})
+	if err != nil {
+		return err
+	}
+
+	return userFile.Save()
+}
+
+func passwd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("no username supplied to 'passwd' command")
+	}
+
+	username := ctx.Args().Get(0)
+
+	userFile, err := openUserFile(ctx, false)
+	if err != nil {
+		return err
+	}
+	user, ok := userFile.Lookup(username)
+	if !ok {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+
+	user.Hash, err = readPassword()
+	if err != nil {
+		return err
+	}
+
+	err = userFile.SetUser(user)
+	if err != nil {
+		return err
+	}
+
+	return userFile.Save()
+}
+
+func setDisabled(ctx *cli.Context, disabled bool) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("no username supplied to '%s' command", ctx.Command.Name)
+	}
+
+	username := ctx.Args().Get(0)
+
+	userFile, err := openUserFile(ctx, false)
+	if err != nil {
+		return err
+	}
+	user, ok := userFile.Lookup(username)
+	if !ok {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+
+	user.Disabled = disabled
+	err = userFile.SetUser(user)
+	if err != nil {
+		return err
+	}
+
+	return userFile.Save()
+}
+
+func role(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return errors.New("'role' command requires a username and a role")
+	}
+
+	username := ctx.Args().Get(0)
+	role, err := auth.ParseRole(ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	userFile, err := openUserFile(ctx, false)
+	if err != nil {
+		return err
+	}
+	user, ok := userFile.Lookup(username)
+	if !ok {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+
+	user.Role = role
+	err = userFile.SetUser(user)
+	if err != nil {
+		return err
+	}
+
+	return userFile.Save()
+}
+
+func groups(ctx *cli.Context) error {
+	if ctx.NArg() < 1 {
+		return errors.New("no username supplied to 'groups' command")
+	}
+
+	username := ctx.Args().Get(0)
+
+	userFile, err := openUserFile(ctx, false)
+	if err != nil {
+		return err
+	}
+	user, ok := userFile.Lookup(username)
+	if !ok {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+
+	user.Groups = ctx.Args().Slice()[1:]
+	err = userFile.SetUser(user)
+	if err != nil {
+		return err
+	}
+
+	return userFile.Save()
+}
+
+func users(ctx *cli.Context) error {
+	userFile, err := openUserFile(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tROLE\tSTATUS\tGROUPS")
+	for _, user := range userFile.Users() {
+		role := user.Role
+		if len(role) == 0 {
+			role = auth.DefaultRole
+		}
+		status := "enabled"
+		if user.Disabled {
+			status = "disabled"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", user.Name, role, status, strings.Join(user.Groups, ","))
+	}
+
+	return tw.Flush()
+}
+
+// readPassword reads a new password and returns its hash. On a terminal, the
+// password is prompted for twice without being echoed. Otherwise, it is the first
+// line of stdin, so that it can be piped in by scripts.
+func readPassword() ([]byte, error) {
+	var pw string
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		first, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprint(os.Stderr, "Confirm password: ")
+		second, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if string(first) != string(second) {
+			return nil, errors.New("passwords do not match")
+		}
+		pw = string(first)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return nil, errors.New("no password supplied on stdin")
+		}
+		pw = strings.TrimRight(line, "\r\n")
+	}
+
+	if len(pw) == 0 {
+		return nil, errors.New("password must not be empty")
+	}
+
+	return auth.HashPassword(pw)
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/bdavs3/worker/client"
+	"github.com/bdavs3/worker/server/api"
+	"github.com/bdavs3/worker/server/auth"
 	"github.com/bdavs3/worker/worker"
 
 	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
 )
 
 func main() {
@@ -24,11 +35,164 @@ func main() {
 		Commands: []*cli.Command{
 			// By default, the CLI includes a "help" command that displays app
 			// info and command usage.
+			{
+				Name:  "login",
+				Usage: "authenticate once with the username and pw environment variables (or a password prompt), then use a session token",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "refresh",
+						Usage: "renew the current session token instead of logging in again",
+					},
+				},
+				Action: workerService.login,
+			},
+			{
+				Name:   "logout",
+				Usage:  "revoke the current session token",
+				Action: workerService.logout,
+			},
 			{
 				Name:    "run",
 				Aliases: []string{"r"},
 				Usage:   "give the server a Linux process to execute",
-				Action:  workerService.run,
+				Flags: []cli.Flag{
+					&cli.Uint64Flag{
+						Name:  "cpu-weight",
+						Usage: "relative share of CPU time, from 1 to 10000",
+					},
+					&cli.Float64Flag{
+						Name:  "cpus",
+						Usage: "maximum number of CPUs the process may use, e.g. 0.5",
+					},
+					&cli.StringFlag{
+						Name:  "memory",
+						Usage: "maximum memory, e.g. 512M (the process is killed above it)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "io-rbps",
+						Usage: "maximum read bandwidth in bytes per second for a device, e.g. 8:0=1048576",
+					},
+					&cli.StringSliceFlag{
+						Name:  "io-wbps",
+						Usage: "maximum write bandwidth in bytes per second for a device, e.g. 8:0=1048576",
+					},
+					&cli.BoolFlag{
+						Name:  "isolate",
+						Usage: "run the process in its own PID, mount, UTS and network namespaces",
+					},
+					&cli.BoolFlag{
+						Name:  "host-network",
+						Usage: "share the host network with an isolated process instead of loopback only",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "terminate the process if it runs for longer than this, e.g. 30m",
+					},
+					&cli.TimestampFlag{
+						Name:   "deadline",
+						Layout: time.RFC3339,
+						Usage:  "terminate the process if it is still running at this time, e.g. 2021-01-02T15:04:05Z",
+					},
+					&cli.StringSliceFlag{
+						Name:    "env",
+						Aliases: []string{"e"},
+						Usage:   "set an environment variable for the process, e.g. -e KEY=value",
+					},
+					&cli.BoolFlag{
+						Name:  "clean-env",
+						Usage: "do not inherit the environment of the server",
+					},
+					&cli.StringFlag{
+						Name:    "dir",
+						Aliases: []string{"C"},
+						Usage:   "working directory of the process",
+					},
+					&cli.StringFlag{
+						Name:  "user",
+						Usage: "run the process as the given user, and optionally group, e.g. nobody:nogroup",
+					},
+					&cli.StringFlag{
+						Name:  "stdin-file",
+						Usage: "feed the contents of a file to the standard input of the process",
+					},
+					&cli.BoolFlag{
+						Name:    "interactive",
+						Aliases: []string{"i"},
+						Usage:   "keep the standard input of the process open for the 'stdin' command",
+					},
+					&cli.BoolFlag{
+						Name:    "tty",
+						Aliases: []string{"t"},
+						Usage:   "run the process on a terminal, for use with the 'attach' command",
+					},
+					&cli.StringSliceFlag{
+						Name:    "label",
+						Aliases: []string{"l"},
+						Usage:   "attach a label to the process, for use with 'ls', e.g. -l env=prod",
+					},
+					&cli.BoolFlag{
+						Name:    "wait",
+						Aliases: []string{"f"},
+						Usage:   "stream the output of the process and exit with its exit code once it ends (Ctrl-C kills it)",
+					},
+					&cli.IntFlag{
+						Name:  "priority",
+						Usage: "if the process is queued, start it before your queued processes of lower priority",
+					},
+					&cli.StringSliceFlag{
+						Name:  "share-user",
+						Usage: "let another user read the status and output of the process",
+					},
+					&cli.StringSliceFlag{
+						Name:  "share-group",
+						Usage: "let the members of a group read the status and output of the process",
+					},
+					&cli.BoolFlag{
+						Name:  "share-control",
+						Usage: "also let the users and groups the process is shared with kill and manage it",
+					},
+				},
+				Action: workerService.run,
+			},
+			{
+				Name:  "ls",
+				Usage: "list the processes you can see (your own and those shared with you, or all of them for admins), most recently created first",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "state",
+						Usage: "only list processes in this state, e.g. active",
+					},
+					&cli.StringFlag{
+						Name:  "command",
+						Usage: "only list processes running this command",
+					},
+					&cli.StringSliceFlag{
+						Name:    "label",
+						Aliases: []string{"l"},
+						Usage:   "only list processes with this label, e.g. -l env=prod, or -l env for any value",
+					},
+					&cli.TimestampFlag{
+						Name:   "created-after",
+						Layout: time.RFC3339,
+						Usage:  "only list processes created after this time, e.g. 2021-01-02T15:04:05Z",
+					},
+					&cli.TimestampFlag{
+						Name:   "created-before",
+						Layout: time.RFC3339,
+						Usage:  "only list processes created before this time, e.g. 2021-01-02T15:04:05Z",
+					},
+					&cli.IntFlag{
+						Name:    "limit",
+						Aliases: []string{"n"},
+						Usage:   "list at most `N` processes (all of them if unset)",
+					},
+				},
+				Action: workerService.ls,
+			},
+			{
+				Name:   "queue",
+				Usage:  "list the processes of all users waiting to start, in the order they are expected to start (admins only)",
+				Action: workerService.queue,
 			},
 			{
 				Name:    "status",
@@ -40,13 +204,121 @@ func main() {
 				Name:    "out",
 				Aliases: []string{"o"},
 				Usage:   "get the output of a process by providing its id",
-				Action:  workerService.out,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "follow",
+						Aliases: []string{"f"},
+						Usage:   "stream the output as it is produced until the process ends",
+					},
+					&cli.BoolFlag{
+						Name:  "stdout",
+						Usage: "only show the standard output of the process",
+					},
+					&cli.BoolFlag{
+						Name:  "stderr",
+						Usage: "only show the standard error of the process",
+					},
+					&cli.IntFlag{
+						Name:  "tail",
+						Usage: "only show the last `N` lines",
+					},
+					&cli.Int64Flag{
+						Name:  "from",
+						Usage: "only show the output from byte `OFFSET` on, and print the offset to continue from to stderr",
+					},
+				},
+				Action: workerService.out,
 			},
 			{
 				Name:    "kill",
 				Aliases: []string{"k"},
-				Usage:   "terminate a process by providing its id",
-				Action:  workerService.kill,
+				Usage:   "terminate a process and its process group by providing its id",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "signal",
+						Aliases: []string{"s"},
+						Value:   "SIGTERM",
+						Usage:   "signal sent to the process group before SIGKILL",
+					},
+					&cli.DurationFlag{
+						Name:    "grace",
+						Aliases: []string{"g"},
+						Usage:   "time given to the process to exit before SIGKILL (server default if unset)",
+					},
+				},
+				Action: workerService.kill,
+			},
+			{
+				Name:      "stdin",
+				Usage:     "send local standard input to a process started with 'run -i', then close it",
+				ArgsUsage: "<id>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "keep-open",
+						Usage: "do not close the standard input of the process afterwards",
+					},
+				},
+				Action: workerService.stdin,
+			},
+			{
+				Name:      "signal",
+				Usage:     "send a signal to a process, e.g. SIGSTOP to pause it and SIGCONT to resume it",
+				ArgsUsage: "<id> <SIGNAL>",
+				Action:    workerService.signal,
+			},
+			{
+				Name:      "wait",
+				Aliases:   []string{"w"},
+				Usage:     "wait for a process to end, then exit with its exit code",
+				ArgsUsage: "<id>",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "give up after this long, exiting with code 124, e.g. 30s",
+					},
+				},
+				Action: workerService.wait,
+			},
+			{
+				Name:      "share",
+				Usage:     "grant other users or groups access to your process, or list the access granted if none are given",
+				ArgsUsage: "<id>",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "user",
+						Usage: "grant access to this user",
+					},
+					&cli.StringSliceFlag{
+						Name:  "group",
+						Usage: "grant access to the members of this group",
+					},
+					&cli.BoolFlag{
+						Name:  "read",
+						Usage: "allow reading the status and output of the process (the default)",
+					},
+					&cli.BoolFlag{
+						Name:  "control",
+						Usage: "also allow killing and managing the process",
+					},
+					&cli.BoolFlag{
+						Name:  "revoke",
+						Usage: "revoke any access granted instead",
+					},
+				},
+				Action: workerService.share,
+			},
+			{
+				Name:      "rm",
+				Usage:     "remove processes that have ended, along with their output, by providing their ids",
+				ArgsUsage: "<id>...",
+				Action:    workerService.rm,
+			},
+			{
+				Name:      "attach",
+				Aliases:   []string{"a"},
+				Usage:     "connect the local terminal to a process, typically one started with 'run -t' (Ctrl-] to detach)",
+				ArgsUsage: "<id>",
+				Action:    workerService.attach,
 			},
 		},
 	}
@@ -66,11 +338,20 @@ type workerService struct {
 // newWorkerService creates a workerService instance containing a Client with which it
 // exchanges data.
 func newWorkerService() (*workerService, error) {
-	client, err := client.NewClient()
+	// A client certificate, if given, identifies the user instead of a password.
+	var opts []client.Option
+	if cert := os.Getenv("client_cert"); len(cert) > 0 {
+		opts = append(opts, client.WithClientCertificate(cert, os.Getenv("client_key")))
+	}
+
+	client, err := client.NewClient(opts...)
 	if err != nil {
 		return nil, err
 	}
 
+	// A token cached by 'login' identifies the user instead of their credentials.
+	client.Token = loadToken(client.BaseURL)
+
 	workerService := &workerService{
 		Client: client,
 	}
@@ -83,21 +364,280 @@ func (ws *workerService) run(ctx *cli.Context) error {
 		return errors.New("no job supplied to 'run' command")
 	}
 
+	limits, err := parseLimits(ctx)
+	if err != nil {
+		return err
+	}
+
 	job := worker.Job{
 		Command: ctx.Args().Get(0),
 		Args:    ctx.Args().Slice()[1:],
+		Limits:  limits,
 	}
+	job.Timeout = ctx.Duration("timeout")
+	job.Deadline = ctx.Timestamp("deadline")
+	job.Env = ctx.StringSlice("env")
+	job.CleanEnv = ctx.Bool("clean-env")
+	job.Dir = ctx.String("dir")
 
-	responseBody, err := ws.Client.PostJob(job)
+	// Like chown, --user accepts "user", "user:group" and ":group".
+	userGroup := strings.SplitN(ctx.String("user"), ":", 2)
+	job.User = userGroup[0]
+	if len(userGroup) == 2 {
+		job.Group = userGroup[1]
+	}
+
+	if path := ctx.String("stdin-file"); len(path) > 0 {
+		job.Stdin, err = ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	job.OpenStdin = ctx.Bool("interactive")
+	job.TTY = ctx.Bool("tty")
+	job.Priority = ctx.Int("priority")
+
+	if labels := ctx.StringSlice("label"); len(labels) > 0 {
+		job.Labels = make(map[string]string, len(labels))
+		for _, label := range labels {
+			keyValue := strings.SplitN(label, "=", 2)
+			if len(keyValue) != 2 {
+				return fmt.Errorf("invalid label %q, want KEY=value", label)
+			}
+			job.Labels[keyValue[0]] = keyValue[1]
+		}
+	}
+
+	if ctx.Bool("isolate") {
+		job.Isolation = &worker.Isolation{HostNetwork: ctx.Bool("host-network")}
+	} else if ctx.Bool("host-network") {
+		return errors.New("--host-network requires --isolate")
+	}
+
+	access := auth.AccessRead
+	if ctx.Bool("share-control") {
+		access = auth.AccessControl
+	}
+	share := grants(ctx.StringSlice("share-user"), ctx.StringSlice("share-group"), access)
+
+	id, err := ws.Client.PostJob(job, share...)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(responseBody)
+	if ctx.Bool("wait") {
+		return ws.runForeground(id)
+	}
+
+	fmt.Println(id)
 
 	return nil
 }
 
+// runForeground streams the output of the process with the given id to the local
+// stdout and stderr until it ends, then exits with its exit code. An interrupt
+// kills the process, and a second one kills it without a grace period.
+func (ws *workerService) runForeground(id string) error {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		sig := ""
+		for {
+			select {
+			case <-interrupts:
+			case <-done:
+				return
+			}
+
+			go func(sig string) {
+				_, err := ws.Client.KillJob(id, sig, 0)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "killing %s: %v\n", id, err)
+				}
+			}(sig)
+			sig = "SIGKILL"
+		}
+	}()
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- ws.Client.StreamJobOutput(id, worker.StreamStdout, os.Stdout)
+	}()
+	go func() {
+		errs <- ws.Client.StreamJobOutput(id, worker.StreamStderr, os.Stderr)
+	}()
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+	}
+
+	status, err := ws.Client.WaitJob(id, 0)
+	if err != nil {
+		return fmt.Errorf("%s: %v", id, err)
+	}
+
+	return exitStatus(status)
+}
+
+// parseLimits builds the resource limits of a job from the flags of the 'run' command.
+func parseLimits(ctx *cli.Context) (worker.Limits, error) {
+	limits := worker.Limits{
+		CPUWeight: ctx.Uint64("cpu-weight"),
+		CPUQuota:  ctx.Float64("cpus"),
+	}
+
+	if ctx.IsSet("memory") {
+		memory, err := parseBytes(ctx.String("memory"))
+		if err != nil {
+			return limits, fmt.Errorf("invalid memory limit: %v", err)
+		}
+		limits.MemoryMax = memory
+	}
+
+	devices := make(map[string]*worker.IOLimit)
+	var order []string
+	device := func(name string) *worker.IOLimit {
+		if _, ok := devices[name]; !ok {
+			devices[name] = &worker.IOLimit{Device: name}
+			order = append(order, name)
+		}
+		return devices[name]
+	}
+
+	for _, flag := range []string{"io-rbps", "io-wbps"} {
+		for _, value := range ctx.StringSlice(flag) {
+			parts := strings.SplitN(value, "=", 2)
+			if len(parts) != 2 {
+				return limits, fmt.Errorf("invalid --%s value %q, want DEVICE=BPS", flag, value)
+			}
+			bps, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				return limits, fmt.Errorf("invalid --%s value %q: %v", flag, value, err)
+			}
+			if flag == "io-rbps" {
+				device(parts[0]).ReadBPS = bps
+			} else {
+				device(parts[0]).WriteBPS = bps
+			}
+		}
+	}
+	for _, name := range order {
+		limits.IO = append(limits.IO, *devices[name])
+	}
+
+	return limits, nil
+}
+
+// parseBytes parses a byte count with an optional K, M or G (binary) suffix.
+func parseBytes(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, errors.New("empty size")
+	}
+
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return n * multiplier, nil
+}
+
+func (ws *workerService) ls(ctx *cli.Context) error {
+	opts := worker.ListOptions{
+		State:         worker.State(ctx.String("state")),
+		Command:       ctx.String("command"),
+		Labels:        ctx.StringSlice("label"),
+		CreatedAfter:  ctx.Timestamp("created-after"),
+		CreatedBefore: ctx.Timestamp("created-before"),
+	}
+	limit := ctx.Int("limit")
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCOMMAND\tSTATE\tEXIT\tAGE")
+
+	now := time.Now()
+	listed := 0
+	for {
+		if limit > 0 {
+			opts.Limit = limit - listed
+		}
+
+		list, err := ws.Client.ListJobs(opts)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range list.Jobs {
+			command := strings.Join(append([]string{job.Command}, job.Args...), " ")
+			exit := "-"
+			if job.Status.ExitCode != nil {
+				exit = strconv.Itoa(*job.Status.ExitCode)
+			} else if len(job.Status.Signal) > 0 {
+				exit = job.Status.Signal
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				job.ID, command, job.Status.State, exit, formatAge(now.Sub(job.Status.Created)))
+		}
+		listed += len(list.Jobs)
+
+		if len(list.Next) == 0 || (limit > 0 && listed >= limit) {
+			break
+		}
+		opts.Cursor = list.Next
+	}
+
+	return tw.Flush()
+}
+
+// formatAge formats a duration in its largest whole unit, e.g. "5m" or "3d".
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+func (ws *workerService) queue(ctx *cli.Context) error {
+	jobs, err := ws.Client.GetQueue()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POSITION\tID\tOWNER\tPRIORITY")
+	for _, job := range jobs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\n", job.Position, job.ID, job.Owner, job.Priority)
+	}
+
+	return tw.Flush()
+}
+
 func (ws *workerService) status(ctx *cli.Context) error {
 	if ctx.NArg() != 1 {
 		return errors.New("no job id supplied to 'status' command")
@@ -105,12 +645,22 @@ func (ws *workerService) status(ctx *cli.Context) error {
 
 	id := ctx.Args().Get(0)
 
-	responseBody, err := ws.Client.GetJobStatus(id)
+	status, err := ws.Client.GetJobStatus(id)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(responseBody)
+	fmt.Println(status)
+	fmt.Printf("created:  %s\n", status.Created.Format(time.RFC3339))
+	if status.Started != nil {
+		fmt.Printf("started:  %s\n", status.Started.Format(time.RFC3339))
+	}
+	if status.Finished != nil {
+		fmt.Printf("finished: %s\n", status.Finished.Format(time.RFC3339))
+	} else if status.Deadline != nil {
+		fmt.Printf("deadline: %s\n", status.Deadline.Format(time.RFC3339))
+	}
+	fmt.Printf("output:   %d bytes\n", status.OutputSize)
 
 	return nil
 }
@@ -122,7 +672,54 @@ func (ws *workerService) out(ctx *cli.Context) error {
 
 	id := ctx.Args().Get(0)
 
-	responseBody, err := ws.Client.GetJobOutput(id)
+	// Selecting both streams is the same as selecting neither.
+	stream := worker.StreamCombined
+	if ctx.Bool("stdout") && !ctx.Bool("stderr") {
+		stream = worker.StreamStdout
+	} else if ctx.Bool("stderr") && !ctx.Bool("stdout") {
+		stream = worker.StreamStderr
+	}
+
+	if ctx.Bool("follow") {
+		if ctx.IsSet("tail") || ctx.IsSet("from") {
+			return errors.New("--follow cannot be combined with --tail or --from")
+		}
+		return ws.Client.StreamJobOutput(id, stream, os.Stdout)
+	}
+
+	if ctx.IsSet("tail") || ctx.IsSet("from") {
+		chunk, err := ws.Client.GetJobOutputRange(id, stream, worker.OutputRange{
+			Offset: ctx.Int64("from"),
+			Tail:   ctx.Int("tail"),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Print(chunk.Output)
+
+		// The server returns a limited amount of output at once, so the rest of the
+		// output produced by the time of the first request is read in pages.
+		end := chunk.Size
+		for chunk.Next < end {
+			offset := chunk.Next
+			chunk, err = ws.Client.GetJobOutputRange(id, stream, worker.OutputRange{Offset: offset})
+			if err != nil {
+				return err
+			}
+			if chunk.Next <= offset {
+				break
+			}
+			fmt.Print(chunk.Output)
+		}
+
+		if ctx.IsSet("from") {
+			fmt.Fprintf(os.Stderr, "next offset: %d (size %d)\n", chunk.Next, chunk.Size)
+		}
+
+		return nil
+	}
+
+	responseBody, err := ws.Client.GetJobOutput(id, stream)
 	if err != nil {
 		return err
 	}
@@ -139,7 +736,25 @@ func (ws *workerService) kill(ctx *cli.Context) error {
 
 	id := ctx.Args().Get(0)
 
-	responseBody, err := ws.Client.KillJob(id)
+	responseBody, err := ws.Client.KillJob(id, ctx.String("signal"), ctx.Duration("grace"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(responseBody)
+
+	return nil
+}
+
+func (ws *workerService) signal(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return errors.New("'signal' command requires a job id and a signal")
+	}
+
+	id := ctx.Args().Get(0)
+	signal := ctx.Args().Get(1)
+
+	responseBody, err := ws.Client.SignalJob(id, signal)
 	if err != nil {
 		return err
 	}
@@ -148,3 +763,233 @@ func (ws *workerService) kill(ctx *cli.Context) error {
 
 	return nil
 }
+
+func (ws *workerService) stdin(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("no job id supplied to 'stdin' command")
+	}
+
+	id := ctx.Args().Get(0)
+
+	_, err := ws.Client.WriteJobStdin(id, os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("keep-open") {
+		return nil
+	}
+
+	_, err = ws.Client.CloseJobStdin(id)
+
+	return err
+}
+
+// waitTimeoutCode is the exit code of the 'wait' command if the process has not
+// ended before the timeout, as with timeout(1).
+const waitTimeoutCode = 124
+
+func (ws *workerService) wait(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("no job id supplied to 'wait' command")
+	}
+
+	id := ctx.Args().Get(0)
+
+	status, err := ws.Client.WaitJob(id, ctx.Duration("timeout"))
+	if err != nil {
+		return err
+	}
+	if !status.Done() {
+		return cli.Exit("timed out waiting for the job to end", waitTimeoutCode)
+	}
+
+	return exitStatus(status)
+}
+
+// exitStatus returns an error making the CLI exit like a process that ended with
+// the given status: with its exit code, or 1 if it did not exit by itself.
+func exitStatus(status *worker.Status) error {
+	if status.ExitCode == nil {
+		return cli.Exit(status.String(), 1)
+	}
+	if *status.ExitCode != 0 {
+		return cli.Exit("", *status.ExitCode)
+	}
+
+	return nil
+}
+
+func (ws *workerService) share(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("no job id supplied to 'share' command")
+	}
+
+	id := ctx.Args().Get(0)
+
+	var access auth.Access
+	switch {
+	case ctx.Bool("read") && ctx.Bool("control"), ctx.Bool("revoke") && (ctx.Bool("read") || ctx.Bool("control")):
+		return errors.New("only one of --read, --control and --revoke may be given")
+	case ctx.Bool("control"):
+		access = auth.AccessControl
+	case !ctx.Bool("revoke"):
+		access = auth.AccessRead
+	}
+
+	var err error
+	var shared []auth.Grant
+	if requested := grants(ctx.StringSlice("user"), ctx.StringSlice("group"), access); len(requested) > 0 {
+		shared, err = ws.Client.ShareJob(id, requested, ctx.Bool("revoke"))
+	} else {
+		shared, err = ws.Client.GetJobSharing(id)
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tGROUP\tACCESS")
+	for _, grant := range shared {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", orDash(grant.User), orDash(grant.Group), grant.Access)
+	}
+
+	return tw.Flush()
+}
+
+// grants returns the grants of the given access to the given users and groups.
+func grants(users, groups []string, access auth.Access) []auth.Grant {
+	var grants []auth.Grant
+	for _, user := range users {
+		grants = append(grants, auth.Grant{User: user, Access: access})
+	}
+	for _, group := range groups {
+		grants = append(grants, auth.Grant{Group: group, Access: access})
+	}
+
+	return grants
+}
+
+// orDash returns s, or "-" if it is empty, for use in tables.
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func (ws *workerService) rm(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return errors.New("no job id supplied to 'rm' command")
+	}
+
+	for _, id := range ctx.Args().Slice() {
+		_, err := ws.Client.RemoveJob(id)
+		if err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+
+		fmt.Println(id)
+	}
+
+	return nil
+}
+
+// detachKey is the key that detaches the 'attach' command from its process (Ctrl-]).
+const detachKey = 0x1d
+
+// errDetached is returned by a detachReader once the detach key has been read.
+var errDetached = errors.New("detached")
+
+// resizePollInterval is how often the 'attach' command checks the size of the local
+// terminal. Polling is used because SIGWINCH is not available on all platforms.
+const resizePollInterval = 250 * time.Millisecond
+
+func (ws *workerService) attach(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("no job id supplied to 'attach' command")
+	}
+
+	id := ctx.Args().Get(0)
+
+	resize := make(chan api.WindowSize, 1)
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+
+		done := make(chan struct{})
+		defer close(done)
+		go watchSize(fd, resize, done)
+	}
+
+	status, err := ws.Client.AttachJob(id, &detachReader{r: os.Stdin}, os.Stdout, resize)
+	if err == errDetached {
+		fmt.Print("\r\ndetached\r\n")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if status.ExitCode != nil && *status.ExitCode != 0 {
+		return cli.Exit("", *status.ExitCode)
+	}
+
+	return nil
+}
+
+// watchSize sends the size of the terminal open on fd to resize, initially and
+// whenever it changes, until done is closed.
+func watchSize(fd int, resize chan<- api.WindowSize, done <-chan struct{}) {
+	var last api.WindowSize
+
+	ticker := time.NewTicker(resizePollInterval)
+	defer ticker.Stop()
+
+	for {
+		cols, rows, err := term.GetSize(fd)
+		size := api.WindowSize{Rows: uint16(rows), Cols: uint16(cols)}
+		if err == nil && size != last {
+			last = size
+			select {
+			case resize <- size:
+			case <-done:
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// A detachReader reads from r until the detach key is read, after which it returns
+// errDetached. Input preceding the detach key is still returned.
+type detachReader struct {
+	r        io.Reader
+	detached bool
+}
+
+func (dr *detachReader) Read(p []byte) (int, error) {
+	if dr.detached {
+		return 0, errDetached
+	}
+
+	n, err := dr.r.Read(p)
+	if i := bytes.IndexByte(p[:n], detachKey); i >= 0 {
+		dr.detached = true
+		if i == 0 {
+			return 0, errDetached
+		}
+		return i, nil
+	}
+
+	return n, err
+}
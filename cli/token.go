@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bdavs3/worker/server/auth"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+// A cachedToken is a token saved by 'login' for later invocations of the CLI.
+type cachedToken struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	// Server is the base URL of the server that issued the token, which is the only
+	// server it is sent to.
+	Server string `json:"server"`
+}
+
+// tokenPath returns the path of the file the token is cached in.
+func tokenPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "worker", "token"), nil
+}
+
+// loadToken returns the cached token for the given server, or an empty string if
+// there is no unexpired one.
+func loadToken(server string) string {
+	path, err := tokenPath()
+	if err != nil {
+		return ""
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	var cached cachedToken
+	err = json.Unmarshal(data, &cached)
+	if err != nil || cached.Server != server || time.Now().After(cached.Expires) {
+		return ""
+	}
+
+	return cached.Token
+}
+
+// saveToken caches a token issued by the given server, readable only by the
+// current user.
+func saveToken(server string, response *auth.TokenResponse) error {
+	path, err := tokenPath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&cachedToken{
+		Token:   response.Token,
+		Expires: response.Expires,
+		Server:  server,
+	})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// removeToken deletes the cached token, if any.
+func removeToken() error {
+	path, err := tokenPath()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (ws *workerService) login(ctx *cli.Context) error {
+	var (
+		response *auth.TokenResponse
+		err      error
+	)
+	if ctx.Bool("refresh") {
+		if len(ws.Client.Token) == 0 {
+			return errors.New("not logged in")
+		}
+		response, err = ws.Client.RefreshToken()
+	} else {
+		var pw string
+		pw, err = loginPassword()
+		if err != nil {
+			return err
+		}
+		ws.Client.Token = ""
+		response, err = ws.Client.Login(os.Getenv("username"), pw)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = saveToken(ws.Client.BaseURL, response)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Logged in until %s\n", response.Expires.Local().Format(time.RFC1123))
+
+	return nil
+}
+
+// loginPassword returns the password to log in with, which is taken from the
+// environment or else prompted for. Users identified by a client certificate do not
+// need one.
+func loginPassword() (string, error) {
+	if pw := os.Getenv("pw"); len(pw) > 0 || len(os.Getenv("username")) == 0 {
+		return pw, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("no password supplied: set the pw environment variable")
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	pw, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pw), nil
+}
+
+func (ws *workerService) logout(ctx *cli.Context) error {
+	var err error
+	if len(ws.Client.Token) > 0 {
+		err = ws.Client.Logout()
+	}
+
+	// The token is forgotten even if the server could not revoke it, e.g. because
+	// it has been restarted since.
+	if removeErr := removeToken(); err == nil {
+		err = removeErr
+	}
+
+	return err
+}
@@ -10,18 +10,17 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bdavs3/worker/server/api"
+	"github.com/bdavs3/worker/server/auth"
 	"github.com/bdavs3/worker/worker"
 )
 
-// TODO (out of scope): Rather than using hard-coded user credentials, provide
-// the user with a way to create an account and log in. Once authenticated
-// with the API, the client could receive a session token that precludes the
-// need to authenticate on each subsequent request.
-
 const (
 	crtFile = "../worker.crt"
 	host    = "https://localhost"
@@ -33,11 +32,39 @@ const (
 type Client struct {
 	BaseURL    string
 	HTTPClient *http.Client
+	// StreamClient is used for requests whose responses are streamed or may be
+	// delayed for a long time, so it does not time out.
+	StreamClient *http.Client
+	// Token, if set, authenticates requests instead of the username and password
+	// in the environment (see Login).
+	Token string
+}
+
+// An Option configures a Client created by NewClient.
+type Option func(*options)
+
+type options struct {
+	certFile, keyFile string
+}
+
+// WithClientCertificate makes the client present the certificate and private key
+// in the given PEM files to the server, which identifies the user to servers that
+// require client certificates.
+func WithClientCertificate(certFile, keyFile string) Option {
+	return func(o *options) {
+		o.certFile = certFile
+		o.keyFile = keyFile
+	}
 }
 
 // NewClient creates a new Client instance that is configured to use
 // a pre-generated certificate for communication over HTTPS.
-func NewClient() (*Client, error) {
+func NewClient(opts ...Option) (*Client, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	port := os.Getenv("port")
 	if len(port) == 0 {
 		port = "443"
@@ -48,15 +75,29 @@ func NewClient() (*Client, error) {
 		return nil, err
 	}
 
+	tlsConfig := &tls.Config{
+		RootCAs: rootCAs,
+	}
+	if len(o.certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+
 	client := &Client{
 		BaseURL: host + ":" + port,
 		HTTPClient: &http.Client{
-			Timeout: timeout,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					RootCAs: rootCAs,
-				},
-			},
+			Timeout:   timeout,
+			Transport: transport,
+		},
+		StreamClient: &http.Client{
+			Transport: transport,
 		},
 	}
 
@@ -80,9 +121,10 @@ func generateCertPool(crtFile string) (*x509.CertPool, error) {
 }
 
 // PostJob passes a Linux process to the worker library for execution and returns
-// the id assigned to that process.
-func (c *Client) PostJob(job worker.Job) (string, error) {
-	requestBody, err := json.Marshal(job)
+// the id assigned to that process. The process is shared according to the given
+// grants, if any.
+func (c *Client) PostJob(job worker.Job, share ...auth.Grant) (string, error) {
+	requestBody, err := json.Marshal(&api.RunRequest{Job: job, Share: share})
 	if err != nil {
 		return "", err
 	}
@@ -99,27 +141,107 @@ func (c *Client) PostJob(job worker.Job) (string, error) {
 	return response.ID, nil
 }
 
-// GetJobStatus queries the status of a process being handled by the worker library
-// and returns it as a string.
-func (c *Client) GetJobStatus(id string) (string, error) {
+// ListJobs queries the processes owned by the user that are selected by opts, most
+// recently created first. Only the filters, Cursor and Limit of opts are used. The
+// Next cursor of the returned list, if set, continues the listing.
+func (c *Client) ListJobs(opts worker.ListOptions) (*worker.JobList, error) {
+	query := url.Values{}
+	if len(opts.State) > 0 {
+		query.Set("state", string(opts.State))
+	}
+	if len(opts.Command) > 0 {
+		query.Set("command", opts.Command)
+	}
+	if opts.CreatedAfter != nil {
+		query.Set("created_after", opts.CreatedAfter.Format(time.RFC3339))
+	}
+	if opts.CreatedBefore != nil {
+		query.Set("created_before", opts.CreatedBefore.Format(time.RFC3339))
+	}
+	for _, label := range opts.Labels {
+		query.Add("label", label)
+	}
+	if len(opts.Cursor) > 0 {
+		query.Set("cursor", opts.Cursor)
+	}
+	if opts.Limit != 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	var list *worker.JobList
+	err := c.decodeRequestWithClient(c.HTTPClient, http.MethodGet, "/jobs?"+query.Encode(), nil, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// GetQueue queries the processes of all users waiting to start, in the order in
+// which they are expected to start. Only admins may query the queue.
+func (c *Client) GetQueue() ([]worker.QueuedJob, error) {
+	var response *api.QueueResponse
+	err := c.decodeRequestWithClient(c.HTTPClient, http.MethodGet, "/queue", nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Jobs, nil
+}
+
+// GetJobSharing queries the access to a process granted to other users. Only the
+// owner of the process may query it.
+func (c *Client) GetJobSharing(id string) ([]auth.Grant, error) {
+	var response *api.ShareResponse
+	err := c.decodeRequestWithClient(c.HTTPClient, http.MethodGet, "/jobs/"+id+"/share", nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Grants, nil
+}
+
+// ShareJob grants other users or groups access to a process, or revokes it if
+// revoke is true, and returns the access granted from then on. Only the owner of the
+// process may share it.
+func (c *Client) ShareJob(id string, grants []auth.Grant, revoke bool) ([]auth.Grant, error) {
+	requestBody, err := json.Marshal(&api.ShareRequest{Grants: grants, Revoke: revoke})
+	if err != nil {
+		return nil, err
+	}
+
+	var response *api.ShareResponse
+	err = c.decodeRequestWithClient(c.HTTPClient, http.MethodPut, "/jobs/"+id+"/share", bytes.NewBuffer(requestBody), &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Grants, nil
+}
+
+// GetJobStatus queries the status of a process being handled by the worker library.
+func (c *Client) GetJobStatus(id string) (*worker.Status, error) {
 	response, err := c.makeRequestWithAuth(
 		http.MethodGet,
 		fmt.Sprintf("/jobs/%s/status", id),
 		nil,
 	)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if response.Status == nil {
+		return nil, errors.New("response does not contain a status")
 	}
 
 	return response.Status, nil
 }
 
-// GetJobOutput queries the output of a process being handled by the worker library
-// and returns it as a string.
-func (c *Client) GetJobOutput(id string) (string, error) {
+// GetJobOutput queries the given output stream of a process being handled by the
+// worker library and returns it as a string.
+func (c *Client) GetJobOutput(id string, stream worker.Stream) (string, error) {
 	response, err := c.makeRequestWithAuth(
 		http.MethodGet,
-		fmt.Sprintf("/jobs/%s/out", id),
+		fmt.Sprintf("/jobs/%s/out?stream=%s", id, stream),
 		nil,
 	)
 	if err != nil {
@@ -129,55 +251,424 @@ func (c *Client) GetJobOutput(id string) (string, error) {
 	return response.Output, nil
 }
 
+// GetJobOutputRange queries part of the given output stream of a process being
+// handled by the worker library, selected by r. The returned chunk tells where to
+// continue reading from, so that output can be polled incrementally.
+func (c *Client) GetJobOutputRange(id string, stream worker.Stream, r worker.OutputRange) (*worker.OutputChunk, error) {
+	query := url.Values{}
+	query.Set("stream", string(stream))
+	query.Set("offset", strconv.FormatInt(r.Offset, 10))
+	if r.Length != 0 {
+		query.Set("length", strconv.FormatInt(r.Length, 10))
+	}
+	if r.Tail != 0 {
+		query.Set("tail", strconv.Itoa(r.Tail))
+	}
+
+	response, err := c.makeRequestWithAuth(
+		http.MethodGet,
+		fmt.Sprintf("/jobs/%s/out?%s", id, query.Encode()),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := &worker.OutputChunk{
+		Output: response.Output,
+		Offset: response.Offset,
+		Next:   response.NextOffset,
+		Size:   response.Size,
+	}
+
+	return chunk, nil
+}
+
+// StreamJobOutput copies the given output stream of a process being handled by the
+// worker library to w as it is produced. It returns once the process has ended.
+func (c *Client) StreamJobOutput(id string, stream worker.Stream, w io.Writer) error {
+	req, err := c.newRequestWithAuth(
+		http.MethodGet,
+		fmt.Sprintf("/jobs/%s/stream?stream=%s", id, stream),
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.StreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s\n%s", http.StatusText(resp.StatusCode), body)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+// WaitJob blocks until a process being handled by the worker library has ended and
+// returns its final status. If timeout is positive and the process is still running
+// once it has passed, WaitJob returns its current status instead, which can be
+// told apart by Done returning false.
+func (c *Client) WaitJob(id string, timeout time.Duration) (*worker.Status, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		// Long polls are kept within the server's limit, and repeated until the
+		// process ends or the timeout passes.
+		poll := api.MaxWaitTimeout
+		if timeout > 0 {
+			poll = time.Until(deadline)
+			if poll < 0 {
+				poll = 0
+			}
+		}
+
+		response, err := c.makeRequestWithClient(
+			c.StreamClient,
+			http.MethodGet,
+			fmt.Sprintf("/jobs/%s/wait?timeout=%s", id, url.QueryEscape(poll.String())),
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if response.Status == nil {
+			return nil, errors.New("response does not contain a status")
+		}
+
+		if response.Status.Done() || (timeout > 0 && !time.Now().Before(deadline)) {
+			return response.Status, nil
+		}
+	}
+}
+
 // KillJob terminates a process being handled by the worker library and returns
-// the result as a string.
-func (c *Client) KillJob(id string) (string, error) {
+// the result as a string. The process group is sent the given signal (SIGTERM if
+// empty), then SIGKILL once the grace period has passed (the server's default if
+// zero). KillJob blocks until the process has ended.
+func (c *Client) KillJob(id, signal string, grace time.Duration) (string, error) {
+	query := url.Values{}
+	if len(signal) > 0 {
+		query.Set("signal", signal)
+	}
+	if grace > 0 {
+		query.Set("grace", grace.String())
+	}
+
+	response, err := c.makeRequestWithClient(
+		c.StreamClient,
+		http.MethodPut,
+		fmt.Sprintf("/jobs/%s/kill?%s", id, query.Encode()),
+		nil,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return response.Message, nil
+}
+
+// SignalJob sends the named signal, e.g. "SIGHUP", to the process group of a process
+// being handled by the worker library and returns the result as a string.
+func (c *Client) SignalJob(id, signal string) (string, error) {
+	query := url.Values{}
+	query.Set("signal", signal)
+
 	response, err := c.makeRequestWithAuth(
 		http.MethodPut,
-		fmt.Sprintf("/jobs/%s/kill", id),
+		fmt.Sprintf("/jobs/%s/signal?%s", id, query.Encode()),
 		nil,
 	)
 	if err != nil {
 		return "", err
 	}
 
-	return response.Status, nil
+	return response.Message, nil
 }
 
-// makeRequestWithAuth makes an HTTP request to the given endpoint
-// after setting the Authorization header. It then returns the response.
-func (c *Client) makeRequestWithAuth(method, endpoint string, requestBody io.Reader) (*api.Response, error) {
-	req, err := http.NewRequest(
-		method,
-		c.BaseURL+endpoint,
-		requestBody,
+// WriteJobStdin writes everything read from r to the standard input of a process
+// being handled by the worker library, which must have been started with an open
+// stdin. Data is streamed to the process as it is read, until r returns EOF.
+func (c *Client) WriteJobStdin(id string, r io.Reader) (string, error) {
+	response, err := c.makeRequestWithClient(
+		c.StreamClient,
+		http.MethodPut,
+		fmt.Sprintf("/jobs/%s/stdin", id),
+		r,
 	)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	return response.Message, nil
+}
+
+// CloseJobStdin closes the standard input of a process being handled by the worker
+// library, which then reads EOF.
+func (c *Client) CloseJobStdin(id string) (string, error) {
+	response, err := c.makeRequestWithAuth(
+		http.MethodPut,
+		fmt.Sprintf("/jobs/%s/stdin/close", id),
+		nil,
+	)
+	if err != nil {
+		return "", err
 	}
 
-	req.SetBasicAuth(os.Getenv("username"), os.Getenv("pw"))
+	return response.Message, nil
+}
 
-	resp, err := c.HTTPClient.Do(req)
+// RemoveJob removes a process that has ended from the worker library, along with
+// its output, and returns the result as a string.
+func (c *Client) RemoveJob(id string) (string, error) {
+	response, err := c.makeRequestWithAuth(
+		http.MethodDelete,
+		fmt.Sprintf("/jobs/%s", id),
+		nil,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return response.Message, nil
+}
+
+// AttachJob connects to a process being handled by the worker library, typically
+// one running on a terminal. Everything read from in is sent to the process and its
+// output is copied to out, and each size received on resize is applied to its
+// terminal. EOF on in closes the process's standard input. AttachJob returns the
+// final status of the process once it has ended, or the error returned by in if it
+// fails first.
+func (c *Client) AttachJob(id string, in io.Reader, out io.Writer, resize <-chan api.WindowSize) (*worker.Status, error) {
+	req, err := c.newRequestWithAuth(
+		http.MethodGet,
+		fmt.Sprintf("/jobs/%s/attach", id),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", api.AttachProtocol)
+
+	resp, err := c.StreamClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s\n%s", http.StatusText(resp.StatusCode), body)
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return nil, errors.New("connection cannot be upgraded")
+	}
+
+	// Input and resize frames are sent concurrently, so writes are serialized.
+	var mu sync.Mutex
+	send := func(typ byte, payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return api.WriteFrame(conn, typ, payload)
+	}
+
+	inErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := in.Read(buf)
+			if n > 0 && send(api.FrameInput, buf[:n]) != nil {
+				return
+			}
+			if err == io.EOF {
+				send(api.FrameEOF, nil)
+				return
+			}
+			if err != nil {
+				inErr <- err
+				conn.Close()
+				return
+			}
+		}
+	}()
+	go func() {
+		for size := range resize {
+			if send(api.FrameResize, size.Encode()) != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		typ, payload, err := api.ReadFrame(conn)
+		if err != nil {
+			select {
+			case err = <-inErr:
+			default:
+			}
+			return nil, err
+		}
+
+		switch typ {
+		case api.FrameOutput:
+			_, err = out.Write(payload)
+			if err != nil {
+				return nil, err
+			}
+		case api.FrameExit:
+			var status *worker.Status
+			err = json.Unmarshal(payload, &status)
+			if err != nil {
+				return nil, err
+			}
+			return status, nil
+		}
+	}
+}
+
+// Login exchanges the given credentials for a token, which authenticates the
+// client's requests from then on until it expires. The token is returned so that it
+// can be reused by later clients.
+func (c *Client) Login(username, pw string) (*auth.TokenResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, c.BaseURL+"/login", nil)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s\n%s", http.StatusText(resp.StatusCode), body)
+	// Users identified by a client certificate do not need a password.
+	if len(username) > 0 {
+		req.SetBasicAuth(username, pw)
+	}
+
+	return c.receiveToken(req)
+}
+
+// RefreshToken exchanges the client's token for a new one, which authenticates the
+// client's requests from then on.
+func (c *Client) RefreshToken() (*auth.TokenResponse, error) {
+	req, err := c.newRequestWithAuth(http.MethodPost, "/login/refresh", nil)
+	if err != nil {
+		return nil, err
 	}
 
+	return c.receiveToken(req)
+}
+
+// receiveToken makes a request responded to with a token and sets the client's
+// token to it.
+func (c *Client) receiveToken(req *http.Request) (*auth.TokenResponse, error) {
+	var response *auth.TokenResponse
+	err := c.decodeResponse(c.HTTPClient, req, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Token = response.Token
+
+	return response, nil
+}
+
+// Logout revokes the client's token.
+func (c *Client) Logout() error {
+	req, err := c.newRequestWithAuth(http.MethodPost, "/logout", nil)
+	if err != nil {
+		return err
+	}
+
+	err = c.decodeResponse(c.HTTPClient, req, nil)
+	if err != nil {
+		return err
+	}
+
+	c.Token = ""
+
+	return nil
+}
+
+// newRequestWithAuth creates an HTTP request to the given endpoint and sets
+// its Authorization header.
+func (c *Client) newRequestWithAuth(method, endpoint string, requestBody io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(
+		method,
+		c.BaseURL+endpoint,
+		requestBody,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Users identified by a client certificate do not need a password.
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if username := os.Getenv("username"); len(username) > 0 {
+		req.SetBasicAuth(username, os.Getenv("pw"))
+	}
+
+	return req, nil
+}
+
+// makeRequestWithAuth makes an HTTP request to the given endpoint
+// after setting the Authorization header. It then returns the response.
+func (c *Client) makeRequestWithAuth(method, endpoint string, requestBody io.Reader) (*api.Response, error) {
+	return c.makeRequestWithClient(c.HTTPClient, method, endpoint, requestBody)
+}
+
+// makeRequestWithClient is like makeRequestWithAuth, but makes the request using
+// the given HTTP client.
+func (c *Client) makeRequestWithClient(httpClient *http.Client, method, endpoint string, requestBody io.Reader) (*api.Response, error) {
 	var response *api.Response
-	err = json.Unmarshal(body, &response)
+	err := c.decodeRequestWithClient(httpClient, method, endpoint, requestBody, &response)
 	if err != nil {
 		return nil, err
 	}
 
 	return response, nil
 }
+
+// decodeRequestWithClient makes an HTTP request to the given endpoint using the
+// given HTTP client and decodes the JSON response into v.
+func (c *Client) decodeRequestWithClient(httpClient *http.Client, method, endpoint string, requestBody io.Reader, v interface{}) error {
+	req, err := c.newRequestWithAuth(method, endpoint, requestBody)
+	if err != nil {
+		return err
+	}
+
+	return c.decodeResponse(httpClient, req, v)
+}
+
+// decodeResponse makes the given request using the given HTTP client and decodes
+// the JSON response into v, unless v is nil.
+func (c *Client) decodeResponse(httpClient *http.Client, req *http.Request, v interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%s\n%s", http.StatusText(resp.StatusCode), body)
+	}
+	if v == nil {
+		return nil
+	}
+
+	return json.Unmarshal(body, v)
+}
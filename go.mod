@@ -10,4 +10,5 @@ require (
 	github.com/google/uuid v1.1.2 // indirect
 	github.com/lithammer/shortuuid v3.0.0+incompatible
 	github.com/urfave/cli/v2 v2.3.0
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
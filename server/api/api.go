@@ -1,9 +1,17 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bdavs3/worker/server/auth"
 	"github.com/bdavs3/worker/worker"
@@ -14,15 +22,45 @@ import (
 // A Response contains information relevant to a particular process in the
 // worker library.
 type Response struct {
-	ID     string `json:"id"`
-	Status string `json:"status,omitempty"`
-	Output string `json:"output,omitempty"`
+	ID      string         `json:"id"`
+	Status  *worker.Status `json:"status,omitempty"`
+	Output  string         `json:"output,omitempty"`
+	Message string         `json:"message,omitempty"`
+
+	// Offset, NextOffset and Size describe the output returned for a range request
+	// (see GetJobOutput).
+	Offset     int64 `json:"offset,omitempty"`
+	NextOffset int64 `json:"next_offset,omitempty"`
+	Size       int64 `json:"size,omitempty"`
+}
+
+// A RunRequest is the body of a request to PostJob: a job, along with the access to
+// it granted to other users.
+type RunRequest struct {
+	worker.Job
+	Share []auth.Grant `json:"share,omitempty"`
+}
+
+// A ShareRequest is the body of a request to ShareJob.
+type ShareRequest struct {
+	Grants []auth.Grant `json:"grants"`
+	// Revoke revokes any access granted to the users and groups of Grants instead
+	// of granting it, in which case their access levels are ignored.
+	Revoke bool `json:"revoke,omitempty"`
+}
+
+// A ShareResponse lists the access granted to a job.
+type ShareResponse struct {
+	Grants []auth.Grant `json:"grants"`
 }
 
 // Handler is an HTTP handler that manages processes on behalf of clients.
 type Handler struct {
 	Worker worker.JobWorker
 	Owners auth.OwnershipRecorder
+	// Access, if set, decides which jobs users may list. Otherwise, users may only
+	// list their own.
+	Access auth.AccessChecker
 }
 
 // NewHandler initalizes a Handler with the given JobWorker and OwnershipRecorder.
@@ -35,7 +73,7 @@ func NewHandler(worker worker.JobWorker, owners auth.OwnershipRecorder) *Handler
 
 // PostJob initiates the worker's execution of the process contained in the request
 // and if successful, responds with the id assigned to that process. It also registers
-// ownership of the new resource.
+// ownership of the new resource, and shares it as requested.
 func (h *Handler) PostJob(w http.ResponseWriter, r *http.Request) {
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -43,17 +81,36 @@ func (h *Handler) PostJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var job worker.Job
-	err = json.Unmarshal(reqBody, &job)
-	if err != nil || len(job.Command) == 0 {
+	var req RunRequest
+	err = json.Unmarshal(reqBody, &req)
+	if err != nil || len(req.Command) == 0 {
 		http.Error(w, "request does not contain a valid job", http.StatusBadRequest)
 		return
 	}
+	for _, grant := range req.Share {
+		err = grant.Validate(true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	id := h.Worker.Run(job)
+	job := req.Job
+	username := auth.Username(r)
+	job.Owner = username
+
+	// Jobs that cannot be run as specified are the client's fault, but failing to
+	// save them is the server's.
+	id, err := h.Worker.Run(job)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
 
-	username, _, _ := r.BasicAuth()
 	h.Owners.SetOwner(username, id)
+	if len(req.Share) > 0 {
+		h.Owners.Share(id, req.Share...)
+	}
 
 	response := &Response{ID: id}
 
@@ -66,6 +123,155 @@ func (h *Handler) PostJob(w http.ResponseWriter, r *http.Request) {
 	w.Write(json)
 }
 
+// ListJobs responds with the jobs the requesting user may read, most recently created
+// first. The optional query parameters "state", "command", "created_after" and
+// "created_before" (RFC 3339 timestamps) and "label" ("key" or "key=value", which
+// may be repeated) filter the jobs listed. At most "limit" jobs are listed at once,
+// and the "next" cursor in the response can be passed back as the "cursor" parameter
+// to list the following ones.
+func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	username := auth.Username(r)
+
+	opts := worker.ListOptions{
+		State:   worker.State(query.Get("state")),
+		Command: query.Get("command"),
+		Labels:  query["label"],
+		Cursor:  query.Get("cursor"),
+		Allow: func(id string) bool {
+			if h.Access != nil {
+				return h.Access.Can(username, auth.ActionRead, id)
+			}
+			return h.Owners.IsOwner(username, id)
+		},
+	}
+
+	var err error
+	opts.CreatedAfter, err = parseQueryTime(query, "created_after")
+	if err == nil {
+		opts.CreatedBefore, err = parseQueryTime(query, "created_before")
+	}
+	if err == nil {
+		var limit int64
+		limit, err = parseQueryInt(query, "limit")
+		opts.Limit = int(limit)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := h.Worker.List(opts)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	json, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
+// parseQueryTime parses the given query parameter as an RFC 3339 timestamp, which is
+// nil if the parameter is not set.
+func parseQueryTime(query url.Values, name string) (*time.Time, error) {
+	value := query.Get(name)
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", name, value)
+	}
+
+	return &t, nil
+}
+
+// A QueueResponse lists the jobs waiting to start (see GetQueue).
+type QueueResponse struct {
+	Jobs []worker.QueuedJob `json:"jobs"`
+}
+
+// GetQueue responds with the jobs of all users waiting to start, in the order in
+// which they are expected to start.
+func (h *Handler) GetQueue(w http.ResponseWriter, r *http.Request) {
+	response := &QueueResponse{Jobs: h.Worker.Queue()}
+
+	json, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
+// GetJobSharing responds with the access to the process represented by the given id
+// granted to other users.
+func (h *Handler) GetJobSharing(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	h.writeSharing(w, id)
+}
+
+// ShareJob grants other users or groups access to the process represented by the
+// given id, or revokes it, and responds with the access granted from then on.
+func (h *Handler) ShareJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "unable to read request", http.StatusBadRequest)
+		return
+	}
+
+	var req ShareRequest
+	err = json.Unmarshal(reqBody, &req)
+	if err != nil || len(req.Grants) == 0 {
+		http.Error(w, "request does not contain any grants", http.StatusBadRequest)
+		return
+	}
+	for _, grant := range req.Grants {
+		err = grant.Validate(!req.Revoke)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The job may have been removed since the request was authorized.
+	_, err = h.Worker.Status(id)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	if req.Revoke {
+		h.Owners.Unshare(id, req.Grants...)
+	} else {
+		h.Owners.Share(id, req.Grants...)
+	}
+
+	h.writeSharing(w, id)
+}
+
+func (h *Handler) writeSharing(w http.ResponseWriter, id string) {
+	response := &ShareResponse{Grants: h.Owners.Grants(id)}
+
+	json, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
 // GetJobStatus responds with the status of the process represented by the given id.
 func (h *Handler) GetJobStatus(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
@@ -76,7 +282,7 @@ func (h *Handler) GetJobStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := &Response{ID: id, Status: status}
+	response := &Response{ID: id, Status: &status}
 
 	json, err := json.Marshal(response)
 	if err != nil {
@@ -88,16 +294,164 @@ func (h *Handler) GetJobStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetJobOutput responds with the output of the process represented by the given id.
+// The optional "stream" query parameter selects stdout, stderr or both combined (the
+// default). Part of the output can be requested with the "offset" and "length" query
+// parameters, in bytes, or "tail" for the last lines, of which at most
+// worker.MaxReadLength bytes are returned. The response to such a request also
+// contains the offset of the output returned, the offset to continue reading from
+// and the total size of the output so far.
 func (h *Handler) GetJobOutput(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	output, err := h.Worker.Out(id)
+	query := r.URL.Query()
+	stream, err := worker.ParseStream(query.Get("stream"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var response *Response
+	if query.Get("offset") == "" && query.Get("length") == "" && query.Get("tail") == "" {
+		output, err := h.Worker.Out(id, stream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		response = &Response{ID: id, Output: output}
+	} else {
+		var rng worker.OutputRange
+		rng.Offset, err = parseQueryInt(query, "offset")
+		if err == nil {
+			rng.Length, err = parseQueryInt(query, "length")
+		}
+		if err == nil {
+			var tail int64
+			tail, err = parseQueryInt(query, "tail")
+			rng.Tail = int(tail)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		chunk, err := h.Worker.ReadOutput(id, stream, rng)
+		if err != nil {
+			http.Error(w, err.Error(), errorCode(err))
+			return
+		}
+
+		response = &Response{
+			ID:         id,
+			Output:     chunk.Output,
+			Offset:     chunk.Offset,
+			NextOffset: chunk.Next,
+			Size:       chunk.Size,
+		}
+	}
+
+	json, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
+// parseQueryInt parses the given query parameter as an integer, which is zero if the
+// parameter is not set.
+func parseQueryInt(query url.Values, name string) (int64, error) {
+	value := query.Get(name)
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+
+	return n, nil
+}
+
+// StreamJobOutput streams the output of the process represented by the given id. The
+// output produced so far is sent immediately, followed by new output as the process
+// writes it. The response ends when the process does. The "stream" query parameter
+// is handled as in GetJobOutput.
+func (h *Handler) StreamJobOutput(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	stream, err := worker.ParseStream(r.URL.Query().Get("stream"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check that the job exists while it is still possible to respond with an error.
+	_, err = h.Worker.Status(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	response := &Response{ID: id, Output: output}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Once the response has begun, errors can no longer be reported to the client.
+	// They only occur if the client goes away, so they are ignored.
+	h.Worker.Follow(r.Context(), id, stream, &flushWriter{w: w, flusher: flusher})
+}
+
+const (
+	// DefaultWaitTimeout is how long WaitJob waits for a job to end by default.
+	DefaultWaitTimeout = 30 * time.Second
+	// MaxWaitTimeout is the longest WaitJob waits for a job to end.
+	MaxWaitTimeout = 5 * time.Minute
+)
+
+// WaitJob waits for the job represented by the given id to end, then responds with
+// its final status. The optional "timeout" query parameter, e.g. "10s", sets how
+// long to wait (DefaultWaitTimeout by default, and at most MaxWaitTimeout). If the
+// job is still running once it has passed, the response holds its current status,
+// so clients should check whether the job has ended and wait again if not.
+func (h *Handler) WaitJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	timeout := DefaultWaitTimeout
+	if value := r.URL.Query().Get("timeout"); len(value) > 0 {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout %q", value), http.StatusBadRequest)
+			return
+		}
+		if timeout > MaxWaitTimeout {
+			timeout = MaxWaitTimeout
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	status, err := h.Worker.Wait(ctx, id)
+	if err == context.DeadlineExceeded {
+		status, err = h.Worker.Status(id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	response := &Response{ID: id, Status: &status}
 
 	json, err := json.Marshal(response)
 	if err != nil {
@@ -108,24 +462,51 @@ func (h *Handler) GetJobOutput(w http.ResponseWriter, r *http.Request) {
 	w.Write(json)
 }
 
-// KillJob terminates the job represented by the given id.
+// A flushWriter flushes every write to the client immediately.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.flusher.Flush()
+	return n, err
+}
+
+// KillJob terminates the job represented by the given id. The optional "signal" query
+// parameter sets the signal sent to the job's process group first (SIGTERM by default),
+// and "grace" sets how long the job is given to exit before it is sent SIGKILL, as a
+// duration such as "5s".
 func (h *Handler) KillJob(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	err := h.Worker.Kill(id)
-	if err != nil {
-		switch err.(type) {
-		case *worker.ErrJobNotActive:
-			http.Error(w, err.Error(), http.StatusConflict)
-		case *worker.ErrJobNotFound:
-			http.Error(w, err.Error(), http.StatusNotFound)
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	var opts worker.KillOptions
+	var err error
+
+	query := r.URL.Query()
+	if name := query.Get("signal"); len(name) > 0 {
+		opts.Signal, err = worker.ParseSignal(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+	}
+	if grace := query.Get("grace"); len(grace) > 0 {
+		opts.Grace, err = time.ParseDuration(grace)
+		if err != nil || opts.Grace <= 0 {
+			http.Error(w, "grace must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = h.Worker.Kill(id, opts)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
 		return
 	}
 
-	response := &Response{ID: id, Status: "job successfully killed"}
+	response := &Response{ID: id, Message: "job successfully killed"}
 
 	json, err := json.Marshal(response)
 	if err != nil {
@@ -135,3 +516,208 @@ func (h *Handler) KillJob(w http.ResponseWriter, r *http.Request) {
 
 	w.Write(json)
 }
+
+// SignalJob sends the signal given by the "signal" query parameter to the job
+// represented by the given id.
+func (h *Handler) SignalJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	name := r.URL.Query().Get("signal")
+	if len(name) == 0 {
+		http.Error(w, "no signal specified", http.StatusBadRequest)
+		return
+	}
+	sig, err := worker.ParseSignal(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.Worker.Signal(id, sig)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	response := &Response{ID: id, Message: "signal successfully sent"}
+
+	json, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
+// WriteJobStdin writes the request body to the standard input of the job represented
+// by the given id. The body may be streamed, in which case it is written as it arrives.
+func (h *Handler) WriteJobStdin(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	n, err := h.Worker.WriteStdin(id, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	response := &Response{ID: id, Message: fmt.Sprintf("%d bytes written to stdin", n)}
+
+	json, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
+// CloseJobStdin closes the standard input of the job represented by the given id.
+func (h *Handler) CloseJobStdin(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := h.Worker.CloseStdin(id)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	response := &Response{ID: id, Message: "stdin successfully closed"}
+
+	json, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
+// DeleteJob removes the job represented by the given id, which must have ended,
+// along with its output.
+func (h *Handler) DeleteJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := h.Worker.Remove(id)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+	h.Owners.RemoveOwner(id)
+
+	response := &Response{ID: id, Message: "job successfully removed"}
+
+	json, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
+// AttachJob upgrades the connection to the attach protocol (see AttachProtocol) and
+// connects it to the job represented by the given id. Input frames are written to the
+// job's terminal or standard input, and resize frames resize its terminal. The job's
+// output is sent as it is produced, starting with the output produced so far, and the
+// session ends with an exit frame once the job has ended.
+func (h *Handler) AttachJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), AttachProtocol) {
+		http.Error(w, "attach requires upgrading to "+AttachProtocol, http.StatusBadRequest)
+		return
+	}
+
+	// Check that the job exists while it is still possible to respond with an error.
+	_, err := h.Worker.Status(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "attach unsupported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: " + AttachProtocol + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		return
+	}
+
+	// The session ends early if the client goes away.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		defer cancel()
+		h.attachInput(id, rw)
+	}()
+
+	out := &frameWriter{w: rw, typ: FrameOutput, flush: rw.Flush}
+	err = h.Worker.Follow(ctx, id, worker.StreamCombined, out)
+	if err != nil {
+		return
+	}
+
+	status, err := h.Worker.Status(id)
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	WriteFrame(rw, FrameExit, payload)
+	rw.Flush()
+}
+
+// attachInput applies the frames read from r to the job represented by the given id
+// until r fails. Input for a job that does not accept any is discarded.
+func (h *Handler) attachInput(id string, r io.Reader) {
+	for {
+		typ, payload, err := ReadFrame(r)
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case FrameInput:
+			h.Worker.WriteStdin(id, bytes.NewReader(payload))
+		case FrameResize:
+			size, err := DecodeWindowSize(payload)
+			if err == nil {
+				h.Worker.Resize(id, size.Rows, size.Cols)
+			}
+		case FrameEOF:
+			h.Worker.CloseStdin(id)
+		}
+	}
+}
+
+// errorCode returns the HTTP status code corresponding to an error returned by the
+// worker library when operating on a job.
+func errorCode(err error) int {
+	switch err.(type) {
+	case *worker.ErrJobNotActive, *worker.ErrJobActive, *worker.ErrStdinClosed, *worker.ErrNoTerminal:
+		return http.StatusConflict
+	case *worker.ErrJobNotFound:
+		return http.StatusNotFound
+	case *worker.ErrInvalidJob, *worker.ErrInvalidRange, *worker.ErrInvalidCursor:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -31,6 +32,11 @@ func TestAPIRequest(t *testing.T) {
 			job:     worker.Job{Command: "", Args: []string{}},
 			want:    http.StatusBadRequest,
 		},
+		{
+			comment: "job that cannot be run as specified",
+			job:     worker.Job{Command: "env", Env: []string{"NOT_AN_ASSIGNMENT"}},
+			want:    http.StatusBadRequest,
+		},
 	}
 
 	for _, test := range tests {
@@ -59,3 +65,74 @@ func TestAPIRequest(t *testing.T) {
 		})
 	}
 }
+
+// failingStore is a worker.Store that cannot save anything, as if its disk were
+// full.
+type failingStore struct{}
+
+var errStoreFull = errors.New("no space left on device")
+
+func (failingStore) SaveJob(info worker.JobInfo) error                { return errStoreFull }
+func (failingStore) SaveStatus(id string, status worker.Status) error { return errStoreFull }
+func (failingStore) LoadJobs() ([]worker.JobInfo, error)              { return nil, errStoreFull }
+func (failingStore) Delete(id string) error                           { return errStoreFull }
+
+func (failingStore) CreateOutput(id string, stream worker.Stream) (worker.OutputFile, error) {
+	return nil, errStoreFull
+}
+
+func (failingStore) OpenOutput(id string, stream worker.Stream) (worker.OutputFile, error) {
+	return nil, errStoreFull
+}
+
+func TestAPIRequestStoreFailure(t *testing.T) {
+	handler := NewHandler(worker.NewWorker(worker.WithStore(failingStore{})), auth.NewOwners())
+
+	requestBody, err := json.Marshal(worker.Job{Command: "true"})
+	if err != nil {
+		t.Fatalf("Error marshalling job as JSON: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/jobs/run", bytes.NewBuffer(requestBody))
+	rec := httptest.NewRecorder()
+
+	http.HandlerFunc(handler.PostJob).ServeHTTP(rec, req)
+
+	// The job is valid, so failing to save it is a server error.
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+
+	size := WindowSize{Rows: 24, Cols: 80}
+	if err := WriteFrame(&buf, FrameResize, size.Encode()); err != nil {
+		t.Fatalf("Error writing frame: %v", err)
+	}
+	if err := WriteFrame(&buf, FrameEOF, nil); err != nil {
+		t.Fatalf("Error writing frame: %v", err)
+	}
+
+	typ, payload, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("Error reading frame: %v", err)
+	}
+	got, err := DecodeWindowSize(payload)
+	if typ != FrameResize || err != nil || got != size {
+		t.Errorf("got frame %q with size %v, want %q with size %v", typ, got, FrameResize, size)
+	}
+
+	typ, payload, err = ReadFrame(&buf)
+	if err != nil || typ != FrameEOF || len(payload) != 0 {
+		t.Errorf("got frame %q with payload %q (%v), want empty %q", typ, payload, err, FrameEOF)
+	}
+
+	// A length beyond the limit is rejected without reading the payload.
+	buf.Reset()
+	buf.Write([]byte{FrameInput, 0xff, 0xff, 0xff, 0xff})
+	_, _, err = ReadFrame(&buf)
+	if err == nil {
+		t.Error("got no error for oversized frame")
+	}
+}
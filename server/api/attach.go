@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// AttachProtocol is the protocol named in the Upgrade header of attach requests.
+// Once the connection has been upgraded, both sides exchange frames made up of a
+// one byte type, a four byte big-endian payload length and the payload itself.
+const AttachProtocol = "worker-attach"
+
+// Frame types sent by the client.
+const (
+	// FrameInput carries bytes for the job's standard input or terminal.
+	FrameInput byte = 'i'
+	// FrameResize carries the new size of the client's terminal, encoded as the
+	// number of rows then columns, each a big-endian uint16.
+	FrameResize byte = 'r'
+	// FrameEOF closes the job's standard input. It has no payload.
+	FrameEOF byte = 'e'
+)
+
+// Frame types sent by the server.
+const (
+	// FrameOutput carries output of the job.
+	FrameOutput byte = 'o'
+	// FrameExit is the last frame of the session, sent once the job has ended. Its
+	// payload is the job's final status, encoded as JSON.
+	FrameExit byte = 'x'
+)
+
+// maxFrameSize bounds the payload of a single frame, so that a corrupt length
+// cannot make the reader allocate an arbitrary amount of memory.
+const maxFrameSize = 1 << 20
+
+// WindowSize is the size of a terminal in characters.
+type WindowSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+// WriteFrame writes a frame of the given type and payload to w.
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return errors.New("frame too large")
+	}
+
+	header := make([]byte, 5)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// ReadFrame reads the next frame from r and returns its type and payload.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, errors.New("frame too large")
+	}
+
+	payload := make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+// Encode returns the payload of a FrameResize frame for the window size.
+func (ws WindowSize) Encode() []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload, ws.Rows)
+	binary.BigEndian.PutUint16(payload[2:], ws.Cols)
+	return payload
+}
+
+// DecodeWindowSize parses the payload of a FrameResize frame.
+func DecodeWindowSize(payload []byte) (WindowSize, error) {
+	if len(payload) != 4 {
+		return WindowSize{}, errors.New("invalid window size")
+	}
+
+	return WindowSize{
+		Rows: binary.BigEndian.Uint16(payload),
+		Cols: binary.BigEndian.Uint16(payload[2:]),
+	}, nil
+}
+
+// A frameWriter sends everything written to it as frames of a single type.
+type frameWriter struct {
+	w   io.Writer
+	typ byte
+	// flush, if set, is called after each frame.
+	flush func() error
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	for off := 0; off < len(p); off += maxFrameSize {
+		end := off + maxFrameSize
+		if end > len(p) {
+			end = len(p)
+		}
+		err := WriteFrame(fw.w, fw.typ, p[off:end])
+		if err != nil {
+			return off, err
+		}
+	}
+	if fw.flush != nil {
+		return len(p), fw.flush()
+	}
+	return len(p), nil
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -8,67 +9,194 @@ import (
 )
 
 const (
+	// The default user, used when the server is not given a user file.
 	storedUsername = "default_user"
 	storedHash     = "$2a$10$P7GoVlD0fEu14OWE76dGzude2NLw0pi05Gzar6rm1b.oD04lcvyaq"
+
+	// dummyHash is compared against the passwords given for unknown and disabled
+	// users, so that rejecting them takes as long as rejecting a wrong password.
+	dummyHash = "$2a$10$BYD0Wdei6hFw90.G1EIAa.WyS.z5Y4bJaLGXTWxjjorGM8O2J5vAO"
 )
 
 // A SecurityLayer can perform security checks on HTTP handlers.
 type SecurityLayer interface {
 	Authenticate(handler http.Handler) http.Handler
-	Authorize(handler http.Handler) http.Handler
+	Authorize(action Action) func(handler http.Handler) http.Handler
 }
 
 // Auth is a SecurityLayer used to enforce security checks on client requests. Use
 // NewAuth to create a new instance.
 type Auth struct {
 	Owners *Owners
+	Users  UserStore
+	// Tokens, if set, issues the bearer tokens users may authenticate with.
+	Tokens *Tokens
+	// Admins holds the usernames of users who are admins regardless of their role
+	// in the user store.
+	Admins map[string]bool
 }
 
-// NewAuth creates a new instance of the auth layer.
-func NewAuth(owners *Owners) *Auth {
+// NewAuth creates a new instance of the auth layer, authenticating the users in the
+// given store.
+func NewAuth(owners *Owners, users UserStore) *Auth {
 	return &Auth{
 		Owners: owners,
+		Users:  users,
 	}
 }
 
-// Authenticate performs an authentication check on an HTTP Handler.
+// Authenticate performs an authentication check on an HTTP Handler. Users are
+// identified by a bearer token, if one is sent, or by a client certificate verified
+// by the TLS layer, or else by their username and password. The handler is given
+// the username of the user (see Username).
 func (a *Auth) Authenticate(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		username, pw, ok := r.BasicAuth()
+		var username string
+		var ok bool
+		if token, bearer := bearerToken(r); bearer {
+			if a.Tokens != nil {
+				username, ok = a.verifyToken(token)
+			}
+		} else if username, ok = certificateUsername(r); ok {
+			// The certificate vouches for the user, but they may have been disabled
+			// since it was issued.
+			user, known := a.Users.Lookup(username)
+			ok = !known || !user.Disabled
+		} else {
+			var pw string
+			username, pw, ok = r.BasicAuth()
+			ok = ok && validate(a.Users, username, pw)
+		}
 
-		if !ok || !validate(username, pw) {
+		if !ok {
 			http.Error(w, "invalid credentials: access denied", http.StatusUnauthorized)
 			return
 		}
 
-		handler.ServeHTTP(w, r)
+		handler.ServeHTTP(w, WithUsername(r, username))
 	})
 }
 
-func validate(username, pw string) bool {
-	// TODO (out of scope): Store user credentials in a secure database and
-	// validate request Authorization headers against them. It is critical
-	// that passwords are hashed before storage in the database.
-	if username == storedUsername {
-		err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(pw))
-		return err == nil
+// validate returns true only if pw is the password of the given user in the store.
+// It takes about as long whether or not the user exists.
+func validate(users UserStore, username, pw string) bool {
+	user, ok := users.Lookup(username)
+	if !ok || user.Disabled {
+		bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(pw))
+		return false
 	}
-	return false
+
+	err := bcrypt.CompareHashAndPassword(user.Hash, []byte(pw))
+	return err == nil
 }
 
-// Authorize performs a resource-ownership check on an HTTP handler.
-func (a *Auth) Authorize(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		username, _, ok := r.BasicAuth()
+// verifyToken returns the username of the user a valid token was issued to, and
+// false if the token is invalid or the user has been removed or disabled since. As
+// with certificates, users who were not in the user store when the token was issued
+// need not be in it, but are rejected if they have been added and disabled since.
+func (a *Auth) verifyToken(token string) (string, bool) {
+	username, external, err := a.Tokens.Verify(token)
+	if err != nil {
+		return "", false
+	}
 
-		id := mux.Vars(r)["id"]
-		if !ok || !a.Owners.IsOwner(username, id) {
-			// If a user tries to access an endpoint belonging to someone else, do not
-			// reveal that the endpoint exists by responding with StatusNotFound.
-			http.Error(w, "job not found", http.StatusNotFound)
-			return
-		}
+	user, known := a.Users.Lookup(username)
+	if external {
+		return username, !known || !user.Disabled
+	}
+	return username, known && !user.Disabled
+}
 
-		handler.ServeHTTP(w, r)
-	})
+// Login responds with a new bearer token for the authenticated user (see Tokens).
+// Users logging in must authenticate with their password or client certificate
+// rather than a token, which can only be renewed by Refresh.
+func (a *Auth) Login(w http.ResponseWriter, r *http.Request) {
+	if _, bearer := bearerToken(r); bearer {
+		http.Error(w, "already logged in: refresh the token instead", http.StatusBadRequest)
+		return
+	}
+
+	a.issueToken(w, Username(r))
+}
+
+// Refresh responds with a new bearer token in exchange for the one the request was
+// authenticated with, which is revoked.
+func (a *Auth) Refresh(w http.ResponseWriter, r *http.Request) {
+	token, bearer := bearerToken(r)
+	if !bearer {
+		http.Error(w, "no token to refresh", http.StatusBadRequest)
+		return
+	}
+
+	err := a.Tokens.Revoke(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	a.issueToken(w, Username(r))
+}
+
+// Logout revokes the bearer token the request was authenticated with.
+func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) {
+	token, bearer := bearerToken(r)
+	if !bearer {
+		http.Error(w, "no token to revoke", http.StatusBadRequest)
+		return
+	}
+
+	err := a.Tokens.Revoke(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Auth) issueToken(w http.ResponseWriter, username string) {
+	if a.Tokens == nil {
+		http.Error(w, "tokens are not enabled", http.StatusNotFound)
+		return
+	}
+
+	// Users identified by a certificate only may log in too.
+	_, known := a.Users.Lookup(username)
+	response, err := a.Tokens.Issue(username, !known)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
+// Authorize returns a middleware checking that users may perform the given action
+// with an HTTP handler, on the job named by the "id" route variable if there is one
+// (see Can).
+func (a *Auth) Authorize(action Action) func(handler http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username := Username(r)
+			id, job := mux.Vars(r)["id"]
+			if job && !a.Can(username, ActionRead, id) {
+				// If a user tries to access a job they cannot see, do not reveal that
+				// the job exists by responding with StatusNotFound.
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			}
+			if !a.Can(username, action, id) {
+				http.Error(w, "permission denied", http.StatusForbidden)
+				return
+			}
+
+			handler.ServeHTTP(w, r)
+		})
+	}
 }
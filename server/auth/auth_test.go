@@ -1,7 +1,20 @@
 package auth
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 func TestAuthentication(t *testing.T) {
@@ -32,10 +45,531 @@ func TestAuthentication(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.comment, func(t *testing.T) {
-			authenticated := validate(test.username, test.pw)
+			authenticated := validate(DefaultUsers(), test.username, test.pw)
 			if authenticated != test.want {
 				t.Errorf("got %t, want %t", authenticated, test.want)
 			}
 		})
 	}
 }
+
+func TestUserFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-users")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+
+	setPassword := func(uf *UserFile, username, pw string, disabled bool) {
+		hash, err := HashPassword(pw)
+		if err == nil {
+			err = uf.SetUser(User{Name: username, Hash: hash, Disabled: disabled})
+		}
+		if err == nil {
+			err = uf.Save()
+		}
+		if err != nil {
+			t.Fatalf("Error saving user %s: %v", username, err)
+		}
+	}
+
+	admin := NewUserFile(path)
+	setPassword(admin, "alice", "wonderland", false)
+	setPassword(admin, "bob", "builder", true)
+	bob, _ := admin.Lookup("bob")
+	bob.Role = RoleViewer
+	bob.Groups = []string{"backend", "ops"}
+	err = admin.SetUser(bob)
+	if err == nil {
+		err = admin.Save()
+	}
+	if err != nil {
+		t.Fatalf("Error saving user bob: %v", err)
+	}
+
+	users, err := LoadUserFile(path)
+	if err != nil {
+		t.Fatalf("Error loading users: %v", err)
+	}
+	if bob, _ := users.Lookup("bob"); bob.Role != RoleViewer || !bob.Disabled || len(bob.Groups) != 2 {
+		t.Errorf("got role %q, groups %v and disabled %t for bob, want %q, [backend ops] and true", bob.Role, bob.Groups, bob.Disabled, RoleViewer)
+	}
+	if !validate(users, "alice", "wonderland") {
+		t.Errorf("alice was not authenticated")
+	}
+	if validate(users, "bob", "builder") {
+		t.Errorf("disabled user bob was authenticated")
+	}
+
+	// Rotating a password takes effect once the file is reloaded.
+	setPassword(admin, "alice", "looking-glass", false)
+	if !validate(users, "alice", "wonderland") {
+		t.Errorf("alice's password changed before reloading")
+	}
+	err = users.Reload()
+	if err != nil {
+		t.Fatalf("Error reloading users: %v", err)
+	}
+	if validate(users, "alice", "wonderland") || !validate(users, "alice", "looking-glass") {
+		t.Errorf("alice's password did not change after reloading")
+	}
+
+	// An invalid file is rejected, keeping the users loaded before.
+	err = ioutil.WriteFile(path, []byte("alice:not-a-hash\n"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing users: %v", err)
+	}
+	err = users.Reload()
+	if err == nil {
+		t.Errorf("invalid user file was loaded")
+	}
+	if !validate(users, "alice", "looking-glass") {
+		t.Errorf("users were lost after failing to reload")
+	}
+}
+
+func TestCertificateAuthentication(t *testing.T) {
+	users := DefaultUsers()
+	users["mallory"] = User{Name: "mallory", Disabled: true}
+	a := NewAuth(NewOwners(), users)
+
+	var tests = []struct {
+		comment  string
+		cert     *x509.Certificate
+		basic    bool // Whether the default user's password is also sent.
+		wantCode int
+		wantUser string
+	}{
+		{
+			comment:  "common name",
+			cert:     &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}},
+			wantCode: http.StatusOK,
+			wantUser: "alice",
+		},
+		{
+			comment:  "email address without a common name",
+			cert:     &x509.Certificate{EmailAddresses: []string{"bob@example.com"}},
+			wantCode: http.StatusOK,
+			wantUser: "bob@example.com",
+		},
+		{
+			comment:  "certificate takes precedence over password",
+			cert:     &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}},
+			basic:    true,
+			wantCode: http.StatusOK,
+			wantUser: "alice",
+		},
+		{
+			comment:  "disabled user",
+			cert:     &x509.Certificate{Subject: pkix.Name{CommonName: "mallory"}},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			comment:  "password without a certificate",
+			basic:    true,
+			wantCode: http.StatusOK,
+			wantUser: "default_user",
+		},
+		{
+			comment:  "no credentials",
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			var gotUser string
+			handler := a.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUser = Username(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+			if test.cert != nil {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{test.cert}}}
+			}
+			if test.basic {
+				r.SetBasicAuth("default_user", "123456")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.wantCode || gotUser != test.wantUser {
+				t.Errorf("got code %d for user %q, want %d for user %q", w.Code, gotUser, test.wantCode, test.wantUser)
+			}
+		})
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	tokens, err := NewTokens(DefaultTokenTTL)
+	if err != nil {
+		t.Fatalf("Error creating tokens: %v", err)
+	}
+	expiring, err := NewTokens(-time.Second)
+	if err != nil {
+		t.Fatalf("Error creating tokens: %v", err)
+	}
+	other, err := NewTokens(DefaultTokenTTL)
+	if err != nil {
+		t.Fatalf("Error creating tokens: %v", err)
+	}
+	users := DefaultUsers()
+	users["bob"] = User{Name: "bob"}
+	users["mallory"] = User{Name: "mallory", Disabled: true}
+	a := NewAuth(NewOwners(), users)
+	a.Tokens = tokens
+
+	issue := func(tokens *Tokens, username string) string {
+		response, err := tokens.Issue(username, false)
+		if err != nil {
+			t.Fatalf("Error issuing token: %v", err)
+		}
+		return response.Token
+	}
+	valid := issue(tokens, "default_user")
+	revoked := issue(tokens, "default_user")
+	err = tokens.Revoke(revoked)
+	if err != nil {
+		t.Fatalf("Error revoking token: %v", err)
+	}
+	// A token claiming to be another user's, under the signature of a valid token.
+	forged := strings.Split(issue(tokens, "bob"), ".")[0] + "." + strings.Split(valid, ".")[1]
+
+	var tests = []struct {
+		comment  string
+		token    string
+		wantCode int
+		wantUser string
+	}{
+		{
+			comment:  "valid token",
+			token:    valid,
+			wantCode: http.StatusOK,
+			wantUser: "default_user",
+		},
+		{
+			comment:  "revoked token",
+			token:    revoked,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			comment:  "expired token",
+			token:    issue(expiring, "default_user"),
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			comment:  "token issued by another server",
+			token:    issue(other, "default_user"),
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			comment:  "forged token",
+			token:    forged,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			comment:  "disabled user",
+			token:    issue(tokens, "mallory"),
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			comment:  "removed user",
+			token:    issue(tokens, "zoe"),
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			var gotUser string
+			handler := a.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUser = Username(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.wantCode || gotUser != test.wantUser {
+				t.Errorf("got code %d for user %q, want %d for user %q", w.Code, gotUser, test.wantCode, test.wantUser)
+			}
+		})
+	}
+}
+
+func TestCertificateLogin(t *testing.T) {
+	tokens, err := NewTokens(DefaultTokenTTL)
+	if err != nil {
+		t.Fatalf("Error creating tokens: %v", err)
+	}
+	users := DefaultUsers()
+	a := NewAuth(NewOwners(), users)
+	a.Tokens = tokens
+
+	// alice is identified by her certificate only, and is not in the user store.
+	login := httptest.NewRequest(http.MethodPost, "/login", nil)
+	login.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+		{Subject: pkix.Name{CommonName: "alice"}},
+	}}}
+	w := httptest.NewRecorder()
+	a.Authenticate(http.HandlerFunc(a.Login)).ServeHTTP(w, login)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got code %d logging in, want %d", w.Code, http.StatusOK)
+	}
+	var response TokenResponse
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("Error decoding token: %v", err)
+	}
+
+	call := func() (int, string) {
+		var gotUser string
+		handler := a.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotUser = Username(r)
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+		r.Header.Set("Authorization", "Bearer "+response.Token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w.Code, gotUser
+	}
+
+	if code, user := call(); code != http.StatusOK || user != "alice" {
+		t.Errorf("got code %d for user %q, want %d for user %q", code, user, http.StatusOK, "alice")
+	}
+
+	// As with her certificate, the token is rejected once she is disabled.
+	users["alice"] = User{Name: "alice", Disabled: true}
+	if code, _ := call(); code != http.StatusUnauthorized {
+		t.Errorf("got code %d for a disabled user, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	users := StaticUsers{
+		"alice": {Name: "alice", Role: RoleAdmin},
+		"bob":   {Name: "bob", Role: RoleOperator},
+		"carol": {Name: "carol", Role: RoleViewer},
+		"dave":  {Name: "dave", Groups: []string{"backend"}},
+		"erin":  {Name: "erin"},
+	}
+	owners := NewOwners()
+	owners.SetOwner("alice", "alicesjob")
+	owners.SetOwner("bob", "bobsjob")
+	owners.SetOwner("carol", "carolsjob")
+	owners.Share("bobsjob",
+		Grant{Group: "backend", Access: AccessRead},
+		Grant{User: "carol", Access: AccessControl},
+		Grant{User: "erin", Access: AccessControl},
+	)
+	a := NewAuth(owners, users)
+
+	var tests = []struct {
+		comment  string
+		username string
+		action   Action
+		id       string
+		wantCode int
+	}{
+		{
+			comment:  "admin reads another user's job",
+			username: "alice",
+			action:   ActionRead,
+			id:       "bobsjob",
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "admin kills another user's job",
+			username: "alice",
+			action:   ActionManage,
+			id:       "bobsjob",
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "admin views the queue",
+			username: "alice",
+			action:   ActionAdmin,
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "operator runs a job",
+			username: "bob",
+			action:   ActionRun,
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "operator kills their own job",
+			username: "bob",
+			action:   ActionManage,
+			id:       "bobsjob",
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "operator reads another user's job",
+			username: "bob",
+			action:   ActionRead,
+			id:       "carolsjob",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			comment:  "operator views the queue",
+			username: "bob",
+			action:   ActionAdmin,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			comment:  "user without a role runs a job",
+			username: "dave",
+			action:   ActionRun,
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "viewer runs a job",
+			username: "carol",
+			action:   ActionRun,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			comment:  "viewer reads a job they can see",
+			username: "carol",
+			action:   ActionRead,
+			id:       "carolsjob",
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "viewer kills a job they can see",
+			username: "carol",
+			action:   ActionManage,
+			id:       "carolsjob",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			comment:  "viewer kills a job they cannot see",
+			username: "carol",
+			action:   ActionManage,
+			id:       "alicesjob",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			comment:  "group member reads a job shared with the group",
+			username: "dave",
+			action:   ActionRead,
+			id:       "bobsjob",
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "group member kills a job shared with the group for reading",
+			username: "dave",
+			action:   ActionManage,
+			id:       "bobsjob",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			comment:  "operator kills a job shared with them for control",
+			username: "erin",
+			action:   ActionManage,
+			id:       "bobsjob",
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "viewer kills a job shared with them for control",
+			username: "carol",
+			action:   ActionManage,
+			id:       "bobsjob",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			comment:  "owner shares their job",
+			username: "bob",
+			action:   ActionShare,
+			id:       "bobsjob",
+			wantCode: http.StatusOK,
+		},
+		{
+			comment:  "user shares a job shared with them",
+			username: "erin",
+			action:   ActionShare,
+			id:       "bobsjob",
+			wantCode: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			handler := a.Authorize(test.action)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := WithUsername(httptest.NewRequest(http.MethodGet, "/", nil), test.username)
+			if len(test.id) > 0 {
+				r = mux.SetURLVars(r, map[string]string{"id": test.id})
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.wantCode {
+				t.Errorf("got code %d, want %d", w.Code, test.wantCode)
+			}
+		})
+	}
+}
+
+// blockingStore is an OwnershipStore that records the ids it saves, and blocks
+// saving while release is not closed, as if its disk were slow. Blocked saves are
+// announced on blocked.
+type blockingStore struct {
+	blocked chan struct{}
+	release chan struct{}
+	saved   []string
+}
+
+func (s *blockingStore) save(id string) error {
+	select {
+	case s.blocked <- struct{}{}:
+	default:
+	}
+	<-s.release
+	s.saved = append(s.saved, id)
+	return nil
+}
+
+func (s *blockingStore) SaveOwner(username, id string) error        { return s.save(id) }
+func (s *blockingStore) DeleteOwner(id string) error                { return s.save(id) }
+func (s *blockingStore) SaveGrants(id string, grants []Grant) error { return s.save(id) }
+func (s *blockingStore) LoadOwners() (map[string]string, error)     { return nil, nil }
+func (s *blockingStore) LoadGrants() (map[string][]Grant, error)    { return nil, nil }
+
+func TestOwnershipStore(t *testing.T) {
+	store := &blockingStore{blocked: make(chan struct{}, 1), release: make(chan struct{})}
+	owners, err := LoadOwners(store)
+	if err != nil {
+		t.Fatalf("Error loading owners: %v", err)
+	}
+
+	saved := make(chan struct{})
+	go func() {
+		owners.SetOwner("alice", "first")
+		saved <- struct{}{}
+	}()
+	<-store.blocked
+
+	// Ownership is checked, and changed, while it cannot be saved.
+	if !owners.IsOwner("alice", "first") {
+		t.Error("ownership not registered before it was saved")
+	}
+	go func() {
+		owners.SetOwner("alice", "second")
+		saved <- struct{}{}
+	}()
+
+	close(store.release)
+	<-saved
+	<-saved
+
+	// Changes are saved in the order they were made.
+	if got := strings.Join(store.saved, ","); got != "first,second" {
+		t.Errorf("got %q saved, want %q", got, "first,second")
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+)
+
+// contextKey is the type of the keys of the values the auth layer stores in request
+// contexts.
+type contextKey int
+
+// usernameKey is the context key of the username of an authenticated request.
+const usernameKey contextKey = iota
+
+// WithUsername returns a copy of r carrying the given username as the identity of
+// the user who made it.
+func WithUsername(r *http.Request, username string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), usernameKey, username))
+}
+
+// Username returns the username of the user who made a request authenticated by
+// Authenticate, or an empty string if the request has not been authenticated.
+func Username(r *http.Request) string {
+	username, _ := r.Context().Value(usernameKey).(string)
+	return username
+}
+
+// certificateUsername returns the username identified by the verified client
+// certificate of a request, and false if there is no such certificate. The username
+// is the common name of the certificate's subject, or if it has none, its first
+// subject alternative name: an email address, DNS name or URI, in that order.
+func certificateUsername(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	return certificateName(r.TLS.VerifiedChains[0][0])
+}
+
+func certificateName(cert *x509.Certificate) (string, bool) {
+	switch {
+	case len(cert.Subject.CommonName) > 0:
+		return cert.Subject.CommonName, true
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0], true
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], true
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String(), true
+	}
+
+	return "", false
+}
@@ -1,35 +1,177 @@
 package auth
 
 import (
+	"fmt"
+	"log"
 	"sync"
 )
 
-// OwnershipRecorder assists in request authorization by tracking resource ownership.
+// An Access is a level of access to a resource granted to users other than its
+// owner.
+type Access string
+
+const (
+	// AccessRead allows reading the status and output of a job.
+	AccessRead Access = "read"
+	// AccessControl also allows killing or signalling a job, using its standard
+	// input or terminal, and removing it.
+	AccessControl Access = "control"
+)
+
+// ParseAccess returns the access level with the given name.
+func ParseAccess(s string) (Access, error) {
+	switch access := Access(s); access {
+	case AccessRead, AccessControl:
+		return access, nil
+	}
+
+	return "", fmt.Errorf("invalid access %q: it must be %s or %s", s, AccessRead, AccessControl)
+}
+
+// includes returns true if the access level allows everything the other one does.
+func (a Access) includes(other Access) bool {
+	return a == other || a == AccessControl && other == AccessRead
+}
+
+// A Grant gives a user, or the members of a group, access to a resource.
+type Grant struct {
+	// Exactly one of User and Group is set.
+	User   string `json:"user,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Access Access `json:"access,omitempty"`
+}
+
+// Validate checks that the grant names exactly one user or group, and a valid
+// access level unless requireAccess is false.
+func (g Grant) Validate(requireAccess bool) error {
+	if (len(g.User) > 0) == (len(g.Group) > 0) {
+		return fmt.Errorf("a grant must name either a user or a group")
+	}
+	if requireAccess || len(g.Access) > 0 {
+		_, err := ParseAccess(string(g.Access))
+		return err
+	}
+
+	return nil
+}
+
+// OwnershipRecorder assists in request authorization by tracking resource ownership
+// and the access granted to other users.
 type OwnershipRecorder interface {
 	SetOwner(username, id string)
 	IsOwner(username, id string) bool
+	RemoveOwner(id string)
+	Share(id string, grants ...Grant)
+	Unshare(id string, grants ...Grant)
+	Grants(id string) []Grant
+}
+
+// An OwnershipStore persists resource ownership, so that it survives restarts.
+type OwnershipStore interface {
+	SaveOwner(username, id string) error
+	DeleteOwner(id string) error
+	// LoadOwners returns the owner of every resource in the store, by resource id.
+	LoadOwners() (map[string]string, error)
+	// SaveGrants replaces the access granted to the resource with the given id.
+	SaveGrants(id string, grants []Grant) error
+	// LoadGrants returns the access granted to every resource in the store that is
+	// shared, by resource id.
+	LoadGrants() (map[string][]Grant, error)
 }
 
-// Owners is the OwnershipRecorder used by the auth layer. Use NewOwners to create a
-// new instance.
+// Owners is the OwnershipRecorder used by the auth layer. Use NewOwners or
+// LoadOwners to create a new instance.
 type Owners struct {
 	// The empty struct allows the inner map to be treated like a set.
 	ownerships map[string]map[string]struct{}
-	mu         sync.RWMutex
+	// grants holds the access granted to each shared resource, by resource id.
+	grants map[string][]Grant
+	mu     sync.RWMutex
+	// store, if set, saves every ownership registered. Changes are saved without
+	// holding mu, but in the order they were made: each change takes a ticket while
+	// holding mu, and waits for its turn to be saved.
+	store    OwnershipStore
+	tickets  uint64 // Guarded by mu.
+	saveMu   sync.Mutex
+	saveTurn *sync.Cond // Signalled on saveMu when saved changes.
+	saved    uint64     // Guarded by saveMu.
 }
 
 // NewOwners creates a new instance of the owner log.
 func NewOwners() *Owners {
-	return &Owners{
+	ot := &Owners{
 		ownerships: make(map[string]map[string]struct{}),
+		grants:     make(map[string][]Grant),
+	}
+	ot.saveTurn = sync.NewCond(&ot.saveMu)
+
+	return ot
+}
+
+// LoadOwners creates a new instance of the owner log holding the ownership saved in
+// the given store, which also saves any ownership registered from then on.
+func LoadOwners(store OwnershipStore) (*Owners, error) {
+	owners, err := store.LoadOwners()
+	if err != nil {
+		return nil, err
+	}
+
+	grants, err := store.LoadGrants()
+	if err != nil {
+		return nil, err
 	}
+
+	ot := NewOwners()
+	for id, username := range owners {
+		ot.setOwnerLocked(username, id)
+	}
+	for id, g := range grants {
+		ot.grants[id] = g
+	}
+	ot.store = store
+
+	return ot, nil
 }
 
 // SetOwner registers the given user as the owner of the resource with the given id.
+// Saving the ownership in the store, if any, is best-effort, since the resource
+// exists regardless.
 func (ot *Owners) SetOwner(username, id string) {
 	ot.mu.Lock()
-	defer ot.mu.Unlock()
+	ot.setOwnerLocked(username, id)
+	ot.unlockAndSave(id, func(store OwnershipStore) error {
+		return store.SaveOwner(username, id)
+	})
+}
 
+// unlockAndSave releases ot.mu, which must be held, and then saves the change just
+// made to the resource with the given id using save. Saving does not hold up
+// access checks, but changes are still saved in order. Failures are only logged.
+func (ot *Owners) unlockAndSave(id string, save func(store OwnershipStore) error) {
+	if ot.store == nil {
+		ot.mu.Unlock()
+		return
+	}
+	ticket := ot.tickets
+	ot.tickets++
+	ot.mu.Unlock()
+
+	ot.saveMu.Lock()
+	defer ot.saveMu.Unlock()
+	for ot.saved != ticket {
+		ot.saveTurn.Wait()
+	}
+
+	err := save(ot.store)
+	if err != nil {
+		log.Printf("saving ownership of %s: %v", id, err)
+	}
+
+	ot.saved++
+	ot.saveTurn.Broadcast()
+}
+
+func (ot *Owners) setOwnerLocked(username, id string) {
 	if _, ok := ot.ownerships[username]; !ok {
 		ot.ownerships[username] = make(map[string]struct{})
 	}
@@ -51,3 +193,124 @@ func (ot *Owners) IsOwner(username, id string) bool {
 
 	return ok
 }
+
+// RemoveOwner forgets the owner of the resource with the given id, e.g. once the
+// resource has been deleted.
+func (ot *Owners) RemoveOwner(id string) {
+	ot.mu.Lock()
+	for username, ids := range ot.ownerships {
+		if _, ok := ids[id]; ok {
+			delete(ids, id)
+			if len(ids) == 0 {
+				delete(ot.ownerships, username)
+			}
+		}
+	}
+	delete(ot.grants, id)
+	ot.unlockAndSave(id, func(store OwnershipStore) error {
+		return store.DeleteOwner(id)
+	})
+}
+
+// Share grants access to the resource with the given id, replacing the access
+// previously granted to the same users and groups. As with SetOwner, saving the
+// grants in the store, if any, is best-effort.
+func (ot *Owners) Share(id string, grants ...Grant) {
+	ot.mu.Lock()
+	shared := ot.withoutLocked(id, grants)
+	shared = append(shared, grants...)
+	ot.setGrantsLocked(id, shared)
+	ot.unlockAndSave(id, func(store OwnershipStore) error {
+		return store.SaveGrants(id, shared)
+	})
+}
+
+// Unshare revokes the access granted to the given users and groups to the resource
+// with the given id, whatever its level.
+func (ot *Owners) Unshare(id string, grants ...Grant) {
+	ot.mu.Lock()
+	kept := ot.withoutLocked(id, grants)
+	ot.setGrantsLocked(id, kept)
+	ot.unlockAndSave(id, func(store OwnershipStore) error {
+		return store.SaveGrants(id, kept)
+	})
+}
+
+// withoutLocked returns the grants of the resource with the given id, except those
+// to the users and groups of the given grants.
+func (ot *Owners) withoutLocked(id string, grants []Grant) []Grant {
+	var kept []Grant
+	for _, existing := range ot.grants[id] {
+		replaced := false
+		for _, grant := range grants {
+			if existing.User == grant.User && existing.Group == grant.Group {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			kept = append(kept, existing)
+		}
+	}
+
+	return kept
+}
+
+func (ot *Owners) setGrantsLocked(id string, grants []Grant) {
+	if len(grants) == 0 {
+		delete(ot.grants, id)
+	} else {
+		ot.grants[id] = grants
+	}
+}
+
+// Grants returns the access granted to the resource with the given id.
+func (ot *Owners) Grants(id string) []Grant {
+	ot.mu.RLock()
+	defer ot.mu.RUnlock()
+
+	return append([]Grant{}, ot.grants[id]...)
+}
+
+// HasAccess returns true only if the given user, who is a member of the given
+// groups, owns the resource with the given id or has been granted the given access
+// to it.
+func (ot *Owners) HasAccess(username string, groups []string, id string, access Access) bool {
+	if ot.IsOwner(username, id) {
+		return true
+	}
+
+	ot.mu.RLock()
+	defer ot.mu.RUnlock()
+
+	for _, grant := range ot.grants[id] {
+		if !grant.Access.includes(access) {
+			continue
+		}
+		if len(grant.User) > 0 && grant.User == username {
+			return true
+		}
+		for _, group := range groups {
+			if len(grant.Group) > 0 && grant.Group == group {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Ownerships returns the ids of the resources owned by each user.
+func (ot *Owners) Ownerships() map[string][]string {
+	ot.mu.RLock()
+	defer ot.mu.RUnlock()
+
+	ownerships := make(map[string][]string, len(ot.ownerships))
+	for username, ids := range ot.ownerships {
+		for id := range ids {
+			ownerships[username] = append(ownerships[username], id)
+		}
+	}
+
+	return ownerships
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"fmt"
+)
+
+// A Role determines what a user may do.
+type Role string
+
+const (
+	// Admins may do anything, to any job.
+	RoleAdmin Role = "admin"
+	// Operators may run jobs, and read and manage their own and those shared with
+	// them.
+	RoleOperator Role = "operator"
+	// Viewers may only read their own jobs and those shared with them, and cannot
+	// run any.
+	RoleViewer Role = "viewer"
+
+	// DefaultRole is the role of users who have not been assigned one, including
+	// users identified by a client certificate who are not in the user store.
+	DefaultRole = RoleOperator
+)
+
+// ParseRole returns the role with the given name.
+func ParseRole(s string) (Role, error) {
+	switch role := Role(s); role {
+	case RoleAdmin, RoleOperator, RoleViewer:
+		return role, nil
+	}
+
+	return "", fmt.Errorf("invalid role %q: it must be %s, %s or %s", s, RoleAdmin, RoleOperator, RoleViewer)
+}
+
+// An Action is something a user may be allowed to do.
+type Action int
+
+const (
+	// ActionRun is submitting a job.
+	ActionRun Action = iota
+	// ActionRead is reading the status and output of a job, or waiting for it.
+	ActionRead
+	// ActionManage is killing or signalling a job, using its standard input or
+	// terminal, or removing it.
+	ActionManage
+	// ActionShare is granting other users access to a job.
+	ActionShare
+	// ActionAdmin is using an endpoint that is not specific to a job, but concerns
+	// every user's jobs, such as the queue.
+	ActionAdmin
+)
+
+// An AccessChecker decides what users may do.
+type AccessChecker interface {
+	Can(username string, action Action, id string) bool
+}
+
+// Role returns the role of the given user.
+func (a *Auth) Role(username string) Role {
+	role, _ := a.lookup(username)
+	return role
+}
+
+// lookup returns the role of the given user and the groups they are a member of.
+func (a *Auth) lookup(username string) (Role, []string) {
+	user, ok := a.Users.Lookup(username)
+	if a.Admins[username] {
+		return RoleAdmin, user.Groups
+	}
+	if !ok || len(user.Role) == 0 {
+		return DefaultRole, user.Groups
+	}
+
+	return user.Role, user.Groups
+}
+
+// Can returns true only if the given user may perform the given action on the job
+// with the given id, which is ignored for actions that do not concern a job. Apart
+// from admins, users may read the jobs they own or have been granted access to,
+// but only operators may manage them, and only owners may share them.
+func (a *Auth) Can(username string, action Action, id string) bool {
+	role, groups := a.lookup(username)
+	if role == RoleAdmin {
+		return true
+	}
+
+	switch action {
+	case ActionRun:
+		return role == RoleOperator
+	case ActionRead:
+		return a.Owners.HasAccess(username, groups, id, AccessRead)
+	case ActionManage:
+		return role == RoleOperator && a.Owners.HasAccess(username, groups, id, AccessControl)
+	case ActionShare:
+		return a.Owners.IsOwner(username, id)
+	}
+
+	return false
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTokenTTL is how long tokens issued by Tokens are valid by default.
+const DefaultTokenTTL = 8 * time.Hour
+
+// ErrInvalidToken occurs when a token is malformed, forged, expired or revoked.
+type ErrInvalidToken struct{ msg string }
+
+func (e *ErrInvalidToken) Error() string { return e.msg }
+
+// A TokenResponse holds a token issued to a user (see Auth.Login).
+type TokenResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// tokenClaims is the signed content of a token.
+type tokenClaims struct {
+	Username string `json:"sub"`
+	ID       string `json:"jti"`
+	Expires  int64  `json:"exp"`
+	// External is set for users who were not in the user store when the token was
+	// issued, i.e. users identified by a client certificate only.
+	External bool `json:"ext,omitempty"`
+}
+
+// Tokens issues and verifies bearer tokens, which identify users without them
+// sending their password on every request. A token is a set of claims signed with
+// HMAC-SHA256 under a key that only lives as long as the Tokens, so restarting the
+// server invalidates every token. Use NewTokens to create an instance.
+type Tokens struct {
+	key []byte
+	ttl time.Duration
+
+	mu sync.Mutex
+	// revoked holds the expiry of every revoked token that has not expired yet, by
+	// token id.
+	revoked map[string]time.Time
+}
+
+// NewTokens creates a new instance issuing tokens valid for the given duration.
+func NewTokens(ttl time.Duration) (*Tokens, error) {
+	key := make([]byte, sha256.Size)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		key:     key,
+		ttl:     ttl,
+		revoked: make(map[string]time.Time),
+	}, nil
+}
+
+// Issue returns a new token for the given user, along with its expiry. External
+// users are those who are not in the user store (see Verify).
+func (t *Tokens) Issue(username string, external bool) (TokenResponse, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	expires := time.Now().Add(t.ttl).Truncate(time.Second)
+	payload, err := json.Marshal(&tokenClaims{
+		Username: username,
+		ID:       hex.EncodeToString(id),
+		Expires:  expires.Unix(),
+		External: external,
+	})
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	token := encoded + "." + t.sign(encoded)
+
+	return TokenResponse{Token: token, Expires: expires}, nil
+}
+
+// Verify returns the username of the user a valid token was issued to, and whether
+// they were issued it as an external user.
+func (t *Tokens) Verify(token string) (string, bool, error) {
+	claims, err := t.verify(token)
+	if err != nil {
+		return "", false, err
+	}
+
+	return claims.Username, claims.External, nil
+}
+
+// Revoke makes the given token invalid before it expires.
+func (t *Tokens) Revoke(token string) error {
+	claims, err := t.verify(token)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Tokens that have expired no longer need to be remembered.
+	now := time.Now()
+	for id, expires := range t.revoked {
+		if now.After(expires) {
+			delete(t.revoked, id)
+		}
+	}
+	t.revoked[claims.ID] = time.Unix(claims.Expires, 0)
+
+	return nil
+}
+
+func (t *Tokens) verify(token string) (*tokenClaims, error) {
+	invalid := &ErrInvalidToken{"invalid token"}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(t.sign(parts[0]))) {
+		return nil, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+	var claims tokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, invalid
+	}
+
+	if time.Now().After(time.Unix(claims.Expires, 0)) {
+		return nil, &ErrInvalidToken{"token expired"}
+	}
+
+	t.mu.Lock()
+	_, revoked := t.revoked[claims.ID]
+	t.mu.Unlock()
+	if revoked {
+		return nil, &ErrInvalidToken{"token revoked"}
+	}
+
+	return &claims, nil
+}
+
+// sign returns the signature of the given encoded claims.
+func (t *Tokens) sign(encoded string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// bearerToken returns the bearer token sent with a request, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	return strings.TrimSpace(header[len(prefix):]), true
+}
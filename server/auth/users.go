@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// disabledMark precedes the password hash of disabled users in a user file.
+const disabledMark = "!"
+
+// A User is an account that may authenticate with the server.
+type User struct {
+	Name string
+	// Hash is the bcrypt hash of the user's password.
+	Hash []byte
+	// Disabled users cannot authenticate.
+	Disabled bool
+	// Role is the role of the user, or empty for DefaultRole.
+	Role Role
+	// Groups holds the names of the groups the user is a member of, which jobs may
+	// be shared with.
+	Groups []string
+}
+
+// A UserStore holds the users that may authenticate with the server.
+type UserStore interface {
+	// Lookup returns the user with the given name, or false if there is none.
+	Lookup(username string) (User, bool)
+}
+
+// StaticUsers is a UserStore holding a fixed set of users, by name.
+type StaticUsers map[string]User
+
+// Lookup returns the user with the given name, or false if there is none.
+func (su StaticUsers) Lookup(username string) (User, bool) {
+	user, ok := su[username]
+	return user, ok
+}
+
+// DefaultUsers returns the users of a server without a user file, which only has
+// the default user.
+func DefaultUsers() StaticUsers {
+	return StaticUsers{
+		storedUsername: {Name: storedUsername, Hash: []byte(storedHash)},
+	}
+}
+
+// HashPassword returns the bcrypt hash of the given password, to be stored in a
+// User.
+func HashPassword(pw string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+}
+
+// ValidateUsername checks that the given name can be stored in a user file.
+func ValidateUsername(username string) error {
+	return validateName("username", username, ":#")
+}
+
+// ValidateGroup checks that the given group name can be stored in a user file.
+func ValidateGroup(group string) error {
+	return validateName("group", group, ":,#")
+}
+
+// validateName checks that a name is non-empty and contains neither whitespace nor
+// any of the reserved characters.
+func validateName(kind, name, reserved string) error {
+	if len(name) == 0 || strings.ContainsAny(name, reserved+" \t\r\n") {
+		return fmt.Errorf("invalid %s %q: it must be non-empty and must not contain whitespace or any of %q",
+			kind, name, reserved)
+	}
+	return nil
+}
+
+// A UserFile is a UserStore kept in a file, in which each line holds a username
+// and the bcrypt hash of their password separated by a colon, as in htpasswd
+// files, optionally followed by another colon and the role of the user, and
+// another colon and a comma-separated list of the user's groups. The hash of a
+// disabled user is preceded by "!". Blank lines and lines starting with "#" are
+// ignored. Use LoadUserFile or NewUserFile to create an instance.
+type UserFile struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// NewUserFile creates an empty user file, which is only written by Save.
+func NewUserFile(path string) *UserFile {
+	return &UserFile{
+		path:  path,
+		users: make(map[string]User),
+	}
+}
+
+// LoadUserFile loads the users from the file at the given path.
+func LoadUserFile(path string) (*UserFile, error) {
+	uf := NewUserFile(path)
+
+	err := uf.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return uf, nil
+}
+
+// Reload replaces the users with those in the file. If the file cannot be read,
+// the users are left as they were.
+func (uf *UserFile) Reload() error {
+	data, err := ioutil.ReadFile(uf.path)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]User)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// bcrypt hashes never contain a colon, so the fields can be split on them.
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 4 || ValidateUsername(fields[0]) != nil {
+			return fmt.Errorf("%s:%d: invalid user entry", uf.path, n)
+		}
+
+		user := User{Name: fields[0]}
+		hash := fields[1]
+		if len(fields) > 2 && len(fields[2]) > 0 {
+			user.Role, err = ParseRole(fields[2])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", uf.path, n, err)
+			}
+		}
+		if len(fields) > 3 {
+			for _, group := range strings.Split(fields[3], ",") {
+				if len(group) == 0 {
+					continue
+				}
+				err = ValidateGroup(group)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %v", uf.path, n, err)
+				}
+				user.Groups = append(user.Groups, group)
+			}
+		}
+		if strings.HasPrefix(hash, disabledMark) {
+			user.Disabled = true
+			hash = strings.TrimPrefix(hash, disabledMark)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("%s:%d: invalid password hash for %s", uf.path, n, user.Name)
+		}
+		user.Hash = []byte(hash)
+
+		users[user.Name] = user
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+
+	uf.mu.Lock()
+	uf.users = users
+	uf.mu.Unlock()
+
+	return nil
+}
+
+// Lookup returns the user with the given name, or false if there is none.
+func (uf *UserFile) Lookup(username string) (User, bool) {
+	uf.mu.RLock()
+	defer uf.mu.RUnlock()
+
+	user, ok := uf.users[username]
+	return user, ok
+}
+
+// Users returns all the users, sorted by name.
+func (uf *UserFile) Users() []User {
+	uf.mu.RLock()
+	defer uf.mu.RUnlock()
+
+	users := make([]User, 0, len(uf.users))
+	for _, user := range uf.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+
+	return users
+}
+
+// SetUser adds the given user, or replaces the user with the same name.
+func (uf *UserFile) SetUser(user User) error {
+	err := ValidateUsername(user.Name)
+	if err != nil {
+		return err
+	}
+	for _, group := range user.Groups {
+		err = ValidateGroup(group)
+		if err != nil {
+			return err
+		}
+	}
+
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+
+	uf.users[user.Name] = user
+	return nil
+}
+
+// Save writes the users to the file, replacing it atomically.
+func (uf *UserFile) Save() error {
+	var buf bytes.Buffer
+	for _, user := range uf.Users() {
+		mark := ""
+		if user.Disabled {
+			mark = disabledMark
+		}
+		// The role and groups are omitted when they are the defaults, and the role is
+		// left empty when only the groups are set.
+		var extra string
+		if len(user.Role) > 0 && user.Role != DefaultRole {
+			extra = ":" + string(user.Role)
+		}
+		if len(user.Groups) > 0 {
+			if len(extra) == 0 {
+				extra = ":"
+			}
+			extra += ":" + strings.Join(user.Groups, ",")
+		}
+		fmt.Fprintf(&buf, "%s:%s%s%s\n", user.Name, mark, user.Hash, extra)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(uf.path), filepath.Base(uf.path)+".")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), uf.path)
+}
@@ -0,0 +1,325 @@
+// Package journal implements a file-backed store for the worker server. Jobs, their
+// statuses, ownership and sharing are appended to a journal file as they change,
+// and job output is kept in a file per job and stream.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bdavs3/worker/server/auth"
+	"github.com/bdavs3/worker/worker"
+)
+
+const (
+	journalFile = "journal"
+	outputDir   = "output"
+)
+
+// A record is a single entry of the journal, recording a new job, the status, the
+// owner or the sharing of a job, or its removal.
+type record struct {
+	ID     string          `json:"id"`
+	Job    *worker.JobInfo `json:"job,omitempty"`
+	Status *worker.Status  `json:"status,omitempty"`
+	Owner  string          `json:"owner,omitempty"`
+	// Grants, if set, replaces the access granted to the job, which is revoked
+	// entirely if it is empty.
+	Grants *[]auth.Grant `json:"grants,omitempty"`
+	// Deleted removes the job, its owner and grants, and Disowned removes its owner
+	// and grants only.
+	Deleted  bool `json:"deleted,omitempty"`
+	Disowned bool `json:"disowned,omitempty"`
+}
+
+// Journal is a worker.Store and auth.OwnershipStore backed by a directory. Use Open
+// to create an instance.
+//
+// Records are written to the journal as soon as they are saved, so they survive the
+// server crashing, although not necessarily the machine crashing.
+type Journal struct {
+	dir string
+
+	mu   sync.Mutex
+	file *os.File
+
+	// The state recorded by the journal when it was opened.
+	jobs   map[string]worker.JobInfo
+	owners map[string]string
+	grants map[string][]auth.Grant
+}
+
+// Open opens the journal kept in the given directory, creating it if necessary. The
+// journal is compacted to the latest record of each kind for every job.
+func Open(dir string) (*Journal, error) {
+	err := os.MkdirAll(filepath.Join(dir, outputDir), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		dir:    dir,
+		jobs:   make(map[string]worker.JobInfo),
+		owners: make(map[string]string),
+		grants: make(map[string][]auth.Grant),
+	}
+
+	err = j.replay()
+	if err != nil {
+		return nil, err
+	}
+	err = j.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	j.file, err = os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// replay loads the state recorded by the journal file, if it exists. Records that
+// cannot be decoded, such as one cut short by a crash, are skipped.
+func (j *Journal) replay() error {
+	f, err := os.Open(filepath.Join(j.dir, journalFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	// Records are read whole however long they are, e.g. for jobs with many
+	// arguments, since every record the journal wrote must be readable again.
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		var r record
+		if json.Unmarshal(line, &r) != nil || len(r.ID) == 0 {
+			continue
+		}
+		if r.Job != nil {
+			j.jobs[r.ID] = *r.Job
+		}
+		if r.Status != nil {
+			info := j.jobs[r.ID]
+			info.ID = r.ID
+			info.Status = *r.Status
+			j.jobs[r.ID] = info
+		}
+		if len(r.Owner) > 0 {
+			j.owners[r.ID] = r.Owner
+		}
+		if r.Grants != nil {
+			if len(*r.Grants) > 0 {
+				j.grants[r.ID] = *r.Grants
+			} else {
+				delete(j.grants, r.ID)
+			}
+		}
+		if r.Deleted {
+			delete(j.jobs, r.ID)
+		}
+		if r.Deleted || r.Disowned {
+			delete(j.owners, r.ID)
+			delete(j.grants, r.ID)
+		}
+	}
+
+	return nil
+}
+
+// compact replaces the journal file with one holding only the loaded state.
+func (j *Journal) compact() error {
+	tmp, err := ioutil.TempFile(j.dir, journalFile+".")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for id, info := range j.jobs {
+		info := info
+		err = enc.Encode(&record{ID: id, Job: &info, Owner: j.owners[id]})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	for id, owner := range j.owners {
+		if _, ok := j.jobs[id]; !ok {
+			err = enc.Encode(&record{ID: id, Owner: owner})
+			if err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	for id, grants := range j.grants {
+		grants := grants
+		err = enc.Encode(&record{ID: id, Grants: &grants})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(j.dir, journalFile))
+}
+
+// append writes a record to the journal.
+func (j *Journal) append(r *record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, err = j.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the journal.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
+
+// SaveJob records a new job.
+func (j *Journal) SaveJob(info worker.JobInfo) error {
+	return j.append(&record{ID: info.ID, Job: &info})
+}
+
+// SaveStatus records the status of the job with the given id.
+func (j *Journal) SaveStatus(id string, status worker.Status) error {
+	return j.append(&record{ID: id, Status: &status})
+}
+
+// LoadJobs returns all jobs recorded when the journal was opened.
+func (j *Journal) LoadJobs() ([]worker.JobInfo, error) {
+	jobs := make([]worker.JobInfo, 0, len(j.jobs))
+	for _, info := range j.jobs {
+		jobs = append(jobs, info)
+	}
+
+	return jobs, nil
+}
+
+// CreateOutput creates the file holding the given output stream of a new job.
+func (j *Journal) CreateOutput(id string, stream worker.Stream) (worker.OutputFile, error) {
+	f, err := os.OpenFile(j.outputPath(id, stream), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// OpenOutput opens the file holding the given output stream of a job for reading.
+func (j *Journal) OpenOutput(id string, stream worker.Stream) (worker.OutputFile, error) {
+	f, err := os.Open(j.outputPath(id, stream))
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Delete removes the job with the given id and its output.
+func (j *Journal) Delete(id string) error {
+	err := j.append(&record{ID: id, Deleted: true})
+	if err != nil {
+		return err
+	}
+
+	for _, stream := range []worker.Stream{worker.StreamStdout, worker.StreamStderr, worker.StreamCombined} {
+		err = os.Remove(j.outputPath(id, stream))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (j *Journal) outputPath(id string, stream worker.Stream) string {
+	return filepath.Join(j.dir, outputDir, id+"."+string(stream))
+}
+
+// SaveOwner records the given user as the owner of the job with the given id.
+func (j *Journal) SaveOwner(username, id string) error {
+	return j.append(&record{ID: id, Owner: username})
+}
+
+// DeleteOwner removes the owner of the job with the given id.
+func (j *Journal) DeleteOwner(id string) error {
+	return j.append(&record{ID: id, Disowned: true})
+}
+
+// LoadOwners returns the owner of every job recorded when the journal was opened,
+// by job id.
+func (j *Journal) LoadOwners() (map[string]string, error) {
+	owners := make(map[string]string, len(j.owners))
+	for id, owner := range j.owners {
+		owners[id] = owner
+	}
+
+	return owners, nil
+}
+
+// SaveGrants records the access granted to the job with the given id, replacing
+// any recorded before.
+func (j *Journal) SaveGrants(id string, grants []auth.Grant) error {
+	if grants == nil {
+		grants = []auth.Grant{}
+	}
+
+	return j.append(&record{ID: id, Grants: &grants})
+}
+
+// LoadGrants returns the access granted to every shared job recorded when the
+// journal was opened, by job id.
+func (j *Journal) LoadGrants() (map[string][]auth.Grant, error) {
+	grants := make(map[string][]auth.Grant, len(j.grants))
+	for id, g := range j.grants {
+		grants[id] = append([]auth.Grant{}, g...)
+	}
+
+	return grants, nil
+}
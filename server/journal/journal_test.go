@@ -0,0 +1,151 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bdavs3/worker/server/auth"
+	"github.com/bdavs3/worker/worker"
+)
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-journal")
+	if err != nil {
+		t.Fatalf("Error creating journal directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+
+	w := worker.NewWorker(worker.WithStore(j))
+	done, err := w.Run(worker.Job{Command: "echo", Args: []string{"hello"}})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	for {
+		status, err := w.Status(done)
+		if err != nil {
+			t.Fatalf("Error getting status: %v", err)
+		}
+		if status.Done() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A job that was running when the worker stopped.
+	err = j.SaveJob(worker.JobInfo{
+		ID:      "running",
+		Command: "sleep",
+		Labels:  map[string]string{"env": "test"},
+		Status:  worker.Status{State: worker.StateActive, Created: time.Now()},
+	})
+	if err != nil {
+		t.Fatalf("Error saving job: %v", err)
+	}
+
+	owners, err := auth.LoadOwners(j)
+	if err != nil {
+		t.Fatalf("Error loading owners: %v", err)
+	}
+	owners.SetOwner("default_user", done)
+	owners.Share(done, auth.Grant{Group: "backend", Access: auth.AccessRead}, auth.Grant{User: "bob", Access: auth.AccessControl})
+	owners.Unshare(done, auth.Grant{User: "bob"})
+
+	// A job that was removed.
+	err = j.SaveJob(worker.JobInfo{ID: "removed", Command: "true", Status: worker.Status{State: worker.StateComplete, Created: time.Now()}})
+	if err == nil {
+		err = j.Delete("removed")
+	}
+	if err != nil {
+		t.Fatalf("Error deleting job: %v", err)
+	}
+	j.Close()
+
+	j, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Error reopening journal: %v", err)
+	}
+	defer j.Close()
+
+	w = worker.NewWorker(worker.WithStore(j))
+	err = w.Restore()
+	if err != nil {
+		t.Fatalf("Error restoring jobs: %v", err)
+	}
+
+	status, err := w.Status(done)
+	if err != nil || status.State != worker.StateComplete {
+		t.Errorf("got status %v (%v), want %s", status, err, worker.StateComplete)
+	}
+	out, err := w.Out(done, worker.StreamStdout)
+	if err != nil || out != "hello\n" {
+		t.Errorf("got output %q (%v), want %q", out, err, "hello\n")
+	}
+
+	_, err = w.Status("removed")
+	if _, ok := err.(*worker.ErrJobNotFound); !ok {
+		t.Errorf("got %v for a removed job, want ErrJobNotFound", err)
+	}
+
+	status, err = w.Status("running")
+	if err != nil || status.State != worker.StateLost {
+		t.Errorf("got status %v (%v), want %s", status, err, worker.StateLost)
+	}
+
+	list, err := w.List(worker.ListOptions{Labels: []string{"env=test"}})
+	if err != nil || len(list.Jobs) != 1 || list.Jobs[0].Command != "sleep" {
+		t.Errorf("got jobs %+v (%v) labeled env=test, want the running job", list.Jobs, err)
+	}
+
+	owners, err = auth.LoadOwners(j)
+	if err != nil {
+		t.Fatalf("Error loading owners: %v", err)
+	}
+	if !owners.IsOwner("default_user", done) {
+		t.Errorf("ownership of %s was not restored", done)
+	}
+	want := []auth.Grant{{Group: "backend", Access: auth.AccessRead}}
+	if grants := owners.Grants(done); !reflect.DeepEqual(grants, want) {
+		t.Errorf("got grants %+v for %s, want %+v", grants, done, want)
+	}
+}
+
+func TestLargeRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-journal")
+	if err != nil {
+		t.Fatalf("Error creating journal directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+
+	// A job whose record is far longer than a typical line.
+	arg := strings.Repeat("x", 2<<20)
+	err = j.SaveJob(worker.JobInfo{ID: "large", Command: "echo", Args: []string{arg}, Status: worker.Status{State: worker.StateComplete, Created: time.Now()}})
+	if err != nil {
+		t.Fatalf("Error saving job: %v", err)
+	}
+	j.Close()
+
+	j, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Error reopening journal: %v", err)
+	}
+	defer j.Close()
+
+	jobs, err := j.LoadJobs()
+	if err != nil || len(jobs) != 1 || len(jobs[0].Args) != 1 || jobs[0].Args[0] != arg {
+		t.Errorf("got %d jobs (%v), want the large job", len(jobs), err)
+	}
+}
@@ -0,0 +1,143 @@
+// Package retention removes finished jobs from the worker server once a retention
+// policy no longer allows them to be kept.
+package retention
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/bdavs3/worker/server/auth"
+	"github.com/bdavs3/worker/worker"
+)
+
+// Policy limits which finished jobs are kept. A zero value in any field leaves the
+// corresponding limit unset. Jobs that are still running are always kept.
+type Policy struct {
+	// MaxAge is how long a job is kept after it has finished.
+	MaxAge time.Duration
+	// MaxJobsPerUser is how many finished jobs of each user are kept. The most
+	// recently finished ones are kept.
+	MaxJobsPerUser int
+	// MaxOutput caps the total output, in bytes, of the finished jobs kept. The
+	// jobs that finished longest ago are removed first.
+	MaxOutput int64
+}
+
+// IsZero returns true if the policy sets no limit.
+func (p Policy) IsZero() bool {
+	return p.MaxAge == 0 && p.MaxJobsPerUser == 0 && p.MaxOutput == 0
+}
+
+// A Collector removes the jobs a Policy does not allow to be kept from the worker,
+// along with their ownership records. Use NewCollector to create an instance.
+type Collector struct {
+	worker worker.JobWorker
+	owners *auth.Owners
+	policy Policy
+}
+
+// NewCollector creates a Collector enforcing the given policy.
+func NewCollector(worker worker.JobWorker, owners *auth.Owners, policy Policy) *Collector {
+	return &Collector{
+		worker: worker,
+		owners: owners,
+		policy: policy,
+	}
+}
+
+// A finishedJob is a job considered for removal.
+type finishedJob struct {
+	id       string
+	finished time.Time
+	size     int64
+}
+
+// Run collects jobs at the given interval until ctx is done.
+func (c *Collector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Collect()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Collect removes the jobs that the policy does not allow to be kept and returns
+// how many were removed.
+func (c *Collector) Collect() int {
+	now := time.Now()
+	removed := 0
+
+	// Jobs kept so far, which still count towards MaxOutput.
+	var kept []finishedJob
+
+	for _, ids := range c.owners.Ownerships() {
+		var jobs []finishedJob
+		for _, id := range ids {
+			status, err := c.worker.Status(id)
+			if err != nil {
+				if _, ok := err.(*worker.ErrJobNotFound); ok {
+					c.owners.RemoveOwner(id)
+				}
+				continue
+			}
+			// Jobs that have been killed or have timed out are only finished once
+			// their process has been reaped.
+			if status.Finished == nil {
+				continue
+			}
+			jobs = append(jobs, finishedJob{id: id, finished: *status.Finished, size: status.OutputSize})
+		}
+
+		sortNewestFirst(jobs)
+		for i, job := range jobs {
+			expired := c.policy.MaxAge > 0 && now.Sub(job.finished) > c.policy.MaxAge
+			excess := c.policy.MaxJobsPerUser > 0 && i >= c.policy.MaxJobsPerUser
+			if expired || excess {
+				if c.remove(job.id) {
+					removed++
+				}
+				continue
+			}
+			kept = append(kept, job)
+		}
+	}
+
+	if c.policy.MaxOutput > 0 {
+		sortNewestFirst(kept)
+
+		var total int64
+		for _, job := range kept {
+			total += job.size
+			if total > c.policy.MaxOutput && c.remove(job.id) {
+				removed++
+			}
+		}
+	}
+
+	return removed
+}
+
+// remove removes a job from the worker and forgets its owner. It returns false if
+// the job could not be removed.
+func (c *Collector) remove(id string) bool {
+	err := c.worker.Remove(id)
+	if err != nil {
+		return false
+	}
+
+	c.owners.RemoveOwner(id)
+	return true
+}
+
+func sortNewestFirst(jobs []finishedJob) {
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].finished.After(jobs[j].finished)
+	})
+}
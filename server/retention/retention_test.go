@@ -0,0 +1,113 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bdavs3/worker/server/auth"
+	"github.com/bdavs3/worker/worker"
+)
+
+func TestCollect(t *testing.T) {
+	var tests = []struct {
+		comment string
+		policy  Policy
+		// kept lists which of the jobs run by the test are kept, oldest first.
+		kept []bool
+	}{
+		{
+			comment: "no policy",
+			kept:    []bool{true, true, true},
+		},
+		{
+			comment: "max age",
+			policy:  Policy{MaxAge: 150 * time.Millisecond},
+			kept:    []bool{false, false, true},
+		},
+		{
+			comment: "max jobs per user",
+			policy:  Policy{MaxJobsPerUser: 2},
+			kept:    []bool{false, true, true},
+		},
+		{
+			comment: "max output",
+			policy:  Policy{MaxOutput: int64(len("hello\n"))},
+			kept:    []bool{false, false, true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			w := worker.NewWorker()
+			owners := auth.NewOwners()
+
+			var ids []string
+			for i := range test.kept {
+				if i == len(test.kept)-1 {
+					time.Sleep(200 * time.Millisecond)
+				}
+				id, err := w.Run(worker.Job{Command: "echo", Args: []string{"hello"}})
+				if err != nil {
+					t.Fatalf("Error running job: %v", err)
+				}
+				owners.SetOwner("default_user", id)
+				waitForJob(t, w, id)
+				ids = append(ids, id)
+			}
+
+			NewCollector(w, owners, test.policy).Collect()
+
+			for i, id := range ids {
+				_, err := w.Status(id)
+				if kept := err == nil; kept != test.kept[i] {
+					t.Errorf("job %d: got kept %t, want %t", i, kept, test.kept[i])
+				}
+				if owned := owners.IsOwner("default_user", id); owned != test.kept[i] {
+					t.Errorf("job %d: got owned %t, want %t", i, owned, test.kept[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCollectKilled(t *testing.T) {
+	w := worker.NewWorker(worker.WithKillGrace(500 * time.Millisecond))
+	owners := auth.NewOwners()
+
+	// A killed job is not collected while its process is still running during its
+	// grace period, however old it is.
+	id, err := w.Run(worker.Job{Command: "sh", Args: []string{"-c", "trap '' TERM; sleep 5"}})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	owners.SetOwner("default_user", id)
+	time.Sleep(100 * time.Millisecond)
+	go w.Kill(id, worker.KillOptions{})
+	time.Sleep(100 * time.Millisecond)
+
+	NewCollector(w, owners, Policy{MaxAge: 50 * time.Millisecond}).Collect()
+
+	_, err = w.Status(id)
+	if err != nil || !owners.IsOwner("default_user", id) {
+		t.Errorf("job was collected during its grace period (%v)", err)
+	}
+	waitForJob(t, w, id)
+}
+
+// waitForJob waits for the job represented by the given id to end.
+func waitForJob(t *testing.T, w *worker.Worker, id string) {
+	t.Helper()
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		status, err := w.Status(id)
+		if err != nil {
+			t.Fatalf("Error getting status: %v", err)
+		}
+		if status.Done() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Job %s did not end", id)
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bdavs3/worker/server/api"
 	"github.com/bdavs3/worker/server/auth"
+	"github.com/bdavs3/worker/server/journal"
+	"github.com/bdavs3/worker/server/retention"
 	"github.com/bdavs3/worker/worker"
 
 	"github.com/gorilla/mux"
@@ -26,6 +37,12 @@ const (
 	crtFile = "../worker.crt"
 	keyFile = "../worker.key"
 	idMatch = "[a-zA-Z0-9]+"
+
+	defaultCgroupParent = "/sys/fs/cgroup/worker"
+
+	// collectInterval is how often finished jobs are checked against the retention
+	// policy.
+	collectInterval = time.Minute
 )
 
 func main() {
@@ -34,26 +51,272 @@ func main() {
 		port = "443"
 	}
 
-	worker := worker.NewWorker()
+	// Unless cgroup_parent is set, only jobs with resource limits are placed in a
+	// cgroup, so that others still run where cgroups are unavailable. Setting it to
+	// an empty string disables cgroups, and with them per-job resource limits.
+	cgroupOption := worker.WithLimitsCgroupParent(defaultCgroupParent)
+	if cgroupParent, ok := os.LookupEnv("cgroup_parent"); ok {
+		cgroupOption = worker.WithCgroupParent(cgroupParent)
+	}
+
+	killGrace := worker.DefaultKillGrace
+	if grace := os.Getenv("kill_grace"); len(grace) > 0 {
+		var err error
+		killGrace, err = time.ParseDuration(grace)
+		if err != nil {
+			log.Fatalf("invalid kill_grace: %v", err)
+		}
+	}
+
+	var maxTimeout time.Duration
+	if timeout := os.Getenv("max_timeout"); len(timeout) > 0 {
+		var err error
+		maxTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatalf("invalid max_timeout: %v", err)
+		}
+	}
+
+	// Output memory caps are given in bytes, with 0 meaning no cap. Output beyond
+	// them is discarded unless output_spill_dir is set.
+	outputMemory := int64(worker.DefaultOutputMemory)
+	if memory := os.Getenv("output_memory"); len(memory) > 0 {
+		var err error
+		outputMemory, err = strconv.ParseInt(memory, 10, 64)
+		if err != nil || outputMemory < 0 {
+			log.Fatalf("invalid output_memory: %s", memory)
+		}
+	}
+	totalOutputMemory := int64(worker.DefaultTotalOutputMemory)
+	if memory := os.Getenv("output_total_memory"); len(memory) > 0 {
+		var err error
+		totalOutputMemory, err = strconv.ParseInt(memory, 10, 64)
+		if err != nil || totalOutputMemory < 0 {
+			log.Fatalf("invalid output_total_memory: %s", memory)
+		}
+	}
+
+	// Jobs run as soon as they are submitted unless max_jobs or max_jobs_per_user
+	// caps how many run at the same time, in which case the others are queued.
+	var maxJobs, maxJobsPerUser int
+	if jobs := os.Getenv("max_jobs"); len(jobs) > 0 {
+		var err error
+		maxJobs, err = strconv.Atoi(jobs)
+		if err != nil || maxJobs < 0 {
+			log.Fatalf("invalid max_jobs: %s", jobs)
+		}
+	}
+	if jobs := os.Getenv("max_jobs_per_user"); len(jobs) > 0 {
+		var err error
+		maxJobsPerUser, err = strconv.Atoi(jobs)
+		if err != nil || maxJobsPerUser < 0 {
+			log.Fatalf("invalid max_jobs_per_user: %s", jobs)
+		}
+	}
+
+	// Queued jobs are started in turn between users, in proportion to the weights
+	// given by user_weights, e.g. "alice=2,bob=1". Users default to a weight of 1.
+	weights := make(map[string]int)
+	for _, userWeight := range splitList(os.Getenv("user_weights")) {
+		keyValue := strings.SplitN(userWeight, "=", 2)
+		var err error
+		if len(keyValue) == 2 {
+			weights[keyValue[0]], err = strconv.Atoi(keyValue[1])
+		}
+		if len(keyValue) != 2 || err != nil || weights[keyValue[0]] <= 0 {
+			log.Fatalf("invalid user_weights: %s", userWeight)
+		}
+	}
+
+	opts := []worker.Option{
+		cgroupOption,
+		worker.WithKillGrace(killGrace),
+		worker.WithMaxTimeout(maxTimeout),
+		worker.WithOutputMemory(outputMemory, totalOutputMemory),
+		worker.WithOutputSpill(os.Getenv("output_spill_dir")),
+		worker.WithConcurrency(maxJobs, maxJobsPerUser),
+		worker.WithUserWeights(weights),
+	}
+
+	// Finished jobs are kept until removed unless a retention policy is set, with
+	// retention_max_age as a duration, retention_max_jobs per user and
+	// retention_max_output in bytes.
+	var policy retention.Policy
+	if age := os.Getenv("retention_max_age"); len(age) > 0 {
+		var err error
+		policy.MaxAge, err = time.ParseDuration(age)
+		if err != nil || policy.MaxAge < 0 {
+			log.Fatalf("invalid retention_max_age: %s", age)
+		}
+	}
+	if jobs := os.Getenv("retention_max_jobs"); len(jobs) > 0 {
+		var err error
+		policy.MaxJobsPerUser, err = strconv.Atoi(jobs)
+		if err != nil || policy.MaxJobsPerUser < 0 {
+			log.Fatalf("invalid retention_max_jobs: %s", jobs)
+		}
+	}
+	if output := os.Getenv("retention_max_output"); len(output) > 0 {
+		var err error
+		policy.MaxOutput, err = strconv.ParseInt(output, 10, 64)
+		if err != nil || policy.MaxOutput < 0 {
+			log.Fatalf("invalid retention_max_output: %s", output)
+		}
+	}
+
+	// Jobs and their owners are only kept in memory unless store_dir is set.
+	var store *journal.Journal
+	if dir := os.Getenv("store_dir"); len(dir) > 0 {
+		var err error
+		store, err = journal.Open(dir)
+		if err != nil {
+			log.Fatalf("opening store: %v", err)
+		}
+		opts = append(opts, worker.WithStore(store))
+	}
+
+	worker := worker.NewWorker(opts...)
 	owners := auth.NewOwners()
-	auth := auth.NewAuth(owners)
+	if store != nil {
+		err := worker.Restore()
+		if err != nil {
+			log.Fatalf("restoring jobs: %v", err)
+		}
+		owners, err = auth.LoadOwners(store)
+		if err != nil {
+			log.Fatalf("restoring owners: %v", err)
+		}
+	}
+	// Only the default user may authenticate unless users_file names a user file,
+	// such as one managed by worker-admin. The file is reloaded on SIGHUP.
+	var users auth.UserStore = auth.DefaultUsers()
+	if path := os.Getenv("users_file"); len(path) > 0 {
+		userFile, err := auth.LoadUserFile(path)
+		if err != nil {
+			log.Fatalf("loading users: %v", err)
+		}
+		go reloadOnHangup(userFile)
+		users = userFile
+	}
+
+	// Users may log in for a token valid for token_ttl, a duration.
+	tokenTTL := auth.DefaultTokenTTL
+	if ttl := os.Getenv("token_ttl"); len(ttl) > 0 {
+		var err error
+		tokenTTL, err = time.ParseDuration(ttl)
+		if err != nil || tokenTTL <= 0 {
+			log.Fatalf("invalid token_ttl: %s", ttl)
+		}
+	}
+	tokens, err := auth.NewTokens(tokenTTL)
+	if err != nil {
+		log.Fatalf("creating token key: %v", err)
+	}
+
+	security := auth.NewAuth(owners, users)
+	security.Tokens = tokens
+	// Users have the role assigned in the user store, but those listed in admins, a
+	// comma-separated list of usernames, are admins regardless.
+	security.Admins = make(map[string]bool)
+	for _, username := range splitList(os.Getenv("admins")) {
+		security.Admins[username] = true
+	}
 	handler := api.NewHandler(worker, owners)
+	handler.Access = security
+
+	if !policy.IsZero() {
+		collector := retention.NewCollector(worker, owners, policy)
+		go collector.Run(context.Background(), collectInterval)
+	}
 
 	router := mux.NewRouter()
-	router.Use(auth.Authenticate)
+	router.Use(security.Authenticate)
 
-	// A subrouter is used to avoid extraneous authorization checks.
-	sub := router.Methods(http.MethodGet, http.MethodPut).Subrouter()
-	sub.Use(auth.Authorize)
+	// Subrouters check the action each route performs against the user's role. Jobs
+	// are listed regardless, since the list only includes the jobs the user may read.
+	run := router.Methods(http.MethodPost).Subrouter()
+	run.Use(security.Authorize(auth.ActionRun))
+	read := router.Methods(http.MethodGet).Subrouter()
+	read.Use(security.Authorize(auth.ActionRead))
+	manage := router.Methods(http.MethodGet, http.MethodPut, http.MethodDelete).Subrouter()
+	manage.Use(security.Authorize(auth.ActionManage))
+	admin := router.Methods(http.MethodGet).Subrouter()
+	admin.Use(security.Authorize(auth.ActionAdmin))
+	share := router.Methods(http.MethodGet, http.MethodPut).Subrouter()
+	share.Use(security.Authorize(auth.ActionShare))
 
-	router.HandleFunc("/jobs/run", handler.PostJob).Methods(http.MethodPost)
-	sub.HandleFunc("/jobs/{id:"+idMatch+"}/status", handler.GetJobStatus).Methods(http.MethodGet)
-	sub.HandleFunc("/jobs/{id:"+idMatch+"}/out", handler.GetJobOutput).Methods(http.MethodGet)
-	sub.HandleFunc("/jobs/{id:"+idMatch+"}/kill", handler.KillJob).Methods(http.MethodPut)
+	router.HandleFunc("/login", security.Login).Methods(http.MethodPost)
+	router.HandleFunc("/login/refresh", security.Refresh).Methods(http.MethodPost)
+	router.HandleFunc("/logout", security.Logout).Methods(http.MethodPost)
+	router.HandleFunc("/jobs", handler.ListJobs).Methods(http.MethodGet)
+	run.HandleFunc("/jobs/run", handler.PostJob)
+	admin.HandleFunc("/queue", handler.GetQueue)
+	read.HandleFunc("/jobs/{id:"+idMatch+"}/status", handler.GetJobStatus)
+	read.HandleFunc("/jobs/{id:"+idMatch+"}/out", handler.GetJobOutput)
+	read.HandleFunc("/jobs/{id:"+idMatch+"}/stream", handler.StreamJobOutput)
+	read.HandleFunc("/jobs/{id:"+idMatch+"}/wait", handler.WaitJob)
+	manage.HandleFunc("/jobs/{id:"+idMatch+"}", handler.DeleteJob).Methods(http.MethodDelete)
+	manage.HandleFunc("/jobs/{id:"+idMatch+"}/kill", handler.KillJob).Methods(http.MethodPut)
+	manage.HandleFunc("/jobs/{id:"+idMatch+"}/signal", handler.SignalJob).Methods(http.MethodPut)
+	manage.HandleFunc("/jobs/{id:"+idMatch+"}/stdin", handler.WriteJobStdin).Methods(http.MethodPut)
+	manage.HandleFunc("/jobs/{id:"+idMatch+"}/stdin/close", handler.CloseJobStdin).Methods(http.MethodPut)
+	manage.HandleFunc("/jobs/{id:"+idMatch+"}/attach", handler.AttachJob).Methods(http.MethodGet)
+	share.HandleFunc("/jobs/{id:"+idMatch+"}/share", handler.GetJobSharing).Methods(http.MethodGet)
+	share.HandleFunc("/jobs/{id:"+idMatch+"}/share", handler.ShareJob).Methods(http.MethodPut)
+
+	server := &http.Server{
+		Addr:      ":" + port,
+		Handler:   router,
+		TLSConfig: &tls.Config{},
+	}
+
+	// Setting client_ca to a file of PEM certificates requires clients to present a
+	// certificate issued by one of them, which identifies the user instead of their
+	// password.
+	if path := os.Getenv("client_ca"); len(path) > 0 {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("reading client_ca: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("invalid client_ca: no certificates found in %s", path)
+		}
+		server.TLSConfig.ClientCAs = clientCAs
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 
 	fmt.Println("Listening...")
-	err := http.ListenAndServeTLS(":"+port, crtFile, keyFile, router)
+	err = server.ListenAndServeTLS(crtFile, keyFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// reloadOnHangup reloads the given user file whenever the server receives SIGHUP.
+// If the file cannot be loaded, the users loaded previously are kept.
+func reloadOnHangup(userFile *auth.UserFile) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		err := userFile.Reload()
+		if err != nil {
+			log.Printf("reloading users: %v", err)
+			continue
+		}
+		log.Printf("reloaded users")
+	}
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
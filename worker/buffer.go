@@ -0,0 +1,464 @@
+package worker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// readChunk is the most data returned by a single read from a syncBuffer, so that
+// following a large spilled output does not load all of it into memory at once.
+const readChunk = 32 * 1024
+
+// A memoryPool accounts for the output held in memory by all syncBuffers sharing
+// it. A nil pool, or one without a limit, grants everything.
+type memoryPool struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// reserve takes up to n bytes from the pool and returns how many were granted.
+func (p *memoryPool) reserve(n int64) int64 {
+	if p == nil {
+		return n
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.limit > 0 && p.used+n > p.limit {
+		n = p.limit - p.used
+		if n < 0 {
+			n = 0
+		}
+	}
+	p.used += n
+
+	return n
+}
+
+// release returns n bytes to the pool.
+func (p *memoryPool) release(n int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.used -= n
+}
+
+// A syncBuffer is an output buffer that is safe for concurrent use. Readers may
+// follow it as it is written to until it is closed.
+//
+// At most limit bytes are held in memory (unless limit is zero), and no more than
+// the pool grants. Beyond that, the oldest output is either moved to a spill file,
+// from which it remains readable, or discarded, in which case readers are told how
+// much was lost. Data is evicted a quarter of the limit at a time, so a buffer that
+// discards output keeps between three quarters of the limit and all of it.
+//
+// The output of jobs saved in a Store is instead written through to a file as well
+// as kept in memory, within the same limits, so nothing needs to be evicted to it.
+type syncBuffer struct {
+	mu   sync.Mutex
+	pool *memoryPool
+
+	limit    int64
+	spillDir string // Spilling is disabled if empty.
+
+	// writeThrough is set while every write goes to the spill file immediately.
+	writeThrough bool
+	// reopen, if set, opens the spill file, which is then closed once the buffer
+	// is closed rather than kept open.
+	reopen func() (OutputFile, error)
+
+	// The buffer holds the bytes written at offsets [0, size). Those before
+	// spilled are in the spill file, those from memStart on are in mem, and any
+	// others were discarded.
+	spill    OutputFile
+	spilled  int64
+	memStart int64
+	mem      []byte
+	size     int64
+
+	closed bool
+	// changed is closed (and replaced) whenever the buffer is written to or closed.
+	changed chan struct{}
+}
+
+// newSyncBuffer creates a buffer holding at most limit bytes in memory (zero for no
+// limit), taken from the given pool. Output beyond that is spilled to a file in
+// spillDir, or discarded if spillDir is empty.
+func newSyncBuffer(limit int64, pool *memoryPool, spillDir string) *syncBuffer {
+	return &syncBuffer{
+		limit:    limit,
+		pool:     pool,
+		spillDir: spillDir,
+	}
+}
+
+// newStoredBuffer creates a buffer like newSyncBuffer that also writes all output
+// to f. Once the buffer is closed, f is closed too and the file is opened with
+// reopen whenever it is read.
+func newStoredBuffer(limit int64, pool *memoryPool, f OutputFile, reopen func() (OutputFile, error)) *syncBuffer {
+	return &syncBuffer{
+		limit:        limit,
+		pool:         pool,
+		writeThrough: true,
+		spill:        f,
+		reopen:       reopen,
+	}
+}
+
+// restoredBuffer creates a closed buffer holding the size bytes of output stored in
+// the file opened by open.
+func restoredBuffer(size int64, open func() (OutputFile, error)) *syncBuffer {
+	return &syncBuffer{
+		reopen:   open,
+		spilled:  size,
+		memStart: size,
+		size:     size,
+		closed:   true,
+	}
+}
+
+func (s *syncBuffer) Write(p []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writeThrough {
+		_, err := s.spill.WriteAt(p, s.size)
+		if err == nil {
+			s.spilled = s.size + int64(len(p))
+		} else {
+			// The output is kept in memory alone from now on.
+			s.writeThrough = false
+		}
+	}
+
+	// keep is how much of the end of p is kept in memory.
+	keep := int64(len(p))
+	if s.limit > 0 {
+		if keep > s.limit {
+			keep = s.limit
+		}
+		if excess := int64(len(s.mem)) + keep - s.limit; excess > 0 {
+			s.evictLocked(excess)
+		}
+	}
+
+	granted := s.pool.reserve(keep)
+	if granted < keep {
+		// Make room at the expense of this buffer before giving up on p.
+		s.evictLocked(int64(len(s.mem)))
+		granted += s.pool.reserve(keep - granted)
+		keep = granted
+	}
+
+	// Anything not kept in memory follows everything already evicted, since the
+	// in-memory data is empty by now.
+	head := p[:int64(len(p))-keep]
+	s.evictedLocked(head)
+	s.memStart += int64(len(head))
+	s.mem = append(s.mem, p[int64(len(p))-keep:]...)
+	s.size += int64(len(p))
+
+	s.notifyLocked()
+
+	return len(p), nil
+}
+
+// evictLocked removes at least n bytes from the start of the in-memory data.
+func (s *syncBuffer) evictLocked(n int64) {
+	if n < s.limit/4 {
+		n = s.limit / 4
+	}
+	if n > int64(len(s.mem)) {
+		n = int64(len(s.mem))
+	}
+	if n == 0 {
+		return
+	}
+
+	s.evictedLocked(s.mem[:n])
+	s.memStart += n
+	s.mem = append(s.mem[:0], s.mem[n:]...)
+	s.pool.release(n)
+}
+
+// evictedLocked spills or discards data that is no longer kept in memory, which
+// starts at memStart. The caller advances memStart past it.
+func (s *syncBuffer) evictedLocked(p []byte) {
+	if len(p) == 0 || s.spilled >= s.memStart+int64(len(p)) {
+		return
+	}
+
+	// Once anything has been discarded, the spill file can no longer be extended.
+	if s.spillDir != "" && s.spilled == s.memStart {
+		err := s.spillLocked(p)
+		if err == nil {
+			s.spilled += int64(len(p))
+		} else {
+			s.spillDir = ""
+		}
+	}
+}
+
+// spillLocked appends p to the spill file, creating it if necessary.
+func (s *syncBuffer) spillLocked(p []byte) error {
+	if s.spill == nil {
+		f, err := ioutil.TempFile(s.spillDir, "worker-output-")
+		if err != nil {
+			return err
+		}
+		// The file is only accessed through f, so it is unlinked straight away and
+		// disappears with the worker. This fails harmlessly where open files cannot
+		// be removed.
+		os.Remove(f.Name())
+		s.spill = f
+	}
+
+	_, err := s.spill.WriteAt(p, s.spilled)
+	return err
+}
+
+// Close marks the end of the output. It does not release the buffer, which
+// remains readable.
+func (s *syncBuffer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.notifyLocked()
+
+	// Stored output no longer needs to be kept open, nor cached in memory.
+	if s.reopen != nil && s.spill != nil {
+		s.spill.Close()
+		s.spill = nil
+		if s.spilled == s.size {
+			s.pool.release(int64(len(s.mem)))
+			s.mem = nil
+			s.memStart = s.size
+		}
+	}
+
+	return nil
+}
+
+// release closes the buffer and frees its memory and spill file. Any output read
+// from it afterwards is reported as discarded.
+func (s *syncBuffer) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pool.release(int64(len(s.mem)))
+	s.mem = nil
+	s.memStart = s.size
+	if s.spill != nil {
+		s.spill.Close()
+		s.spill = nil
+	}
+	s.spilled = 0
+	s.spillDir = ""
+	s.writeThrough = false
+	s.reopen = nil
+
+	s.closed = true
+	s.notifyLocked()
+}
+
+// len returns the number of bytes written to the buffer.
+func (s *syncBuffer) len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+func (s *syncBuffer) notifyLocked() {
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// readFrom returns a copy of up to readChunk bytes written after the given offset,
+// the offset to read from next and whether the buffer has been closed. In place of
+// discarded output, it returns a line saying how much was discarded. If there is
+// nothing new to read, the returned channel is closed as soon as there is.
+func (s *syncBuffer) readFrom(off int64) ([]byte, int64, bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off < s.size {
+		data, next := s.chunkLocked(off, readChunk)
+		return data, next, s.closed, nil
+	}
+
+	if s.closed {
+		return nil, off, true, nil
+	}
+
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+
+	return nil, off, false, s.changed
+}
+
+// chunkLocked returns a copy of up to n bytes written after the given offset and
+// the offset following them, stopping at the end of the spill file or discarded
+// output. In place of discarded output, it returns a line saying how much was
+// discarded.
+func (s *syncBuffer) chunkLocked(off, n int64) ([]byte, int64) {
+	switch {
+	case off >= s.size:
+		return nil, off
+	case off >= s.memStart:
+		if off+n > s.size {
+			n = s.size - off
+		}
+		data := make([]byte, n)
+		copy(data, s.mem[off-s.memStart:])
+		return data, off + n
+	case off < s.spilled:
+		if off+n > s.spilled {
+			n = s.spilled - off
+		}
+		data := make([]byte, n)
+		err := s.readSpillLocked(data, off)
+		if err != nil {
+			// The output cannot be recovered, so it is treated as discarded.
+			return discarded(s.memStart - off), s.memStart
+		}
+		return data, off + n
+	}
+
+	return discarded(s.memStart - off), s.memStart
+}
+
+// readSpillLocked reads len(p) bytes at the given offset of the spill file.
+func (s *syncBuffer) readSpillLocked(p []byte, off int64) error {
+	f := s.spill
+	if f == nil {
+		var err error
+		f, err = s.reopen()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	_, err := f.ReadAt(p, off)
+	return err
+}
+
+// read returns the part of the output selected by r.
+func (s *syncBuffer) read(r OutputRange) OutputChunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	off := r.Offset
+	if r.Tail > 0 {
+		off = s.tailLocked(r.Tail)
+	}
+
+	length := r.Length
+	if length == 0 || length > MaxReadLength {
+		length = MaxReadLength
+	}
+	end := s.size
+	if off+length < end {
+		end = off + length
+	}
+
+	var data []byte
+	next := off
+	for next < end {
+		var chunk []byte
+		chunk, next = s.chunkLocked(next, end-next)
+		data = append(data, chunk...)
+	}
+
+	return OutputChunk{
+		Output: string(data),
+		Offset: off,
+		Next:   next,
+		Size:   s.size,
+	}
+}
+
+// tailLocked returns the offset at which the last n lines of the output start. A
+// final newline does not begin another line. If fewer lines have been retained, it
+// returns the offset of the oldest line that can be read in full.
+func (s *syncBuffer) tailLocked(n int) int64 {
+	first := s.memStart
+	if s.spilled >= s.memStart {
+		first = 0
+	}
+
+	end := s.size
+	if end > first {
+		last, _ := s.chunkLocked(end-1, 1)
+		if len(last) == 1 && last[0] == '\n' {
+			end--
+		}
+	}
+
+	// oldest is the start of the oldest line found so far.
+	oldest := first
+	for end > first {
+		// Chunks are read backwards, without crossing from memory to the spill file.
+		start := end - readChunk
+		if start < first {
+			start = first
+		}
+		if start < s.memStart && end > s.memStart {
+			start = s.memStart
+		}
+
+		data, _ := s.chunkLocked(start, end-start)
+		for i := len(data) - 1; i >= 0; i-- {
+			if data[i] == '\n' {
+				oldest = start + int64(i) + 1
+				n--
+				if n == 0 {
+					return oldest
+				}
+			}
+		}
+
+		end = start
+	}
+
+	// The oldest retained line may have been cut short by discarding the output
+	// preceding it.
+	if first > 0 {
+		return oldest
+	}
+
+	return first
+}
+
+// discarded returns the line read in place of n bytes of discarded output.
+func discarded(n int64) []byte {
+	return []byte(fmt.Sprintf("[%d bytes of output discarded]\n", n))
+}
+
+func (s *syncBuffer) String() string {
+	var b strings.Builder
+
+	var off int64
+	for {
+		data, next, _, _ := s.readFrom(off)
+		if len(data) == 0 {
+			return b.String()
+		}
+		b.Write(data)
+		off = next
+	}
+}
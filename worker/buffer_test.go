@@ -0,0 +1,188 @@
+package worker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBufferLimits(t *testing.T) {
+	spillDir, err := ioutil.TempDir("", "worker-test")
+	if err != nil {
+		t.Fatalf("Error creating spill directory: %v", err)
+	}
+	defer os.RemoveAll(spillDir)
+
+	var tests = []struct {
+		comment  string
+		limit    int64
+		pool     *memoryPool
+		spillDir string
+		want     string
+	}{
+		{
+			comment: "unlimited",
+			want:    "aaaaaaaabbbbbbbbcccccccc",
+		},
+		{
+			comment: "ring buffer",
+			limit:   10,
+			want:    "[14 bytes of output discarded]\nbbcccccccc",
+		},
+		{
+			comment:  "spill to disk",
+			limit:    10,
+			spillDir: spillDir,
+			want:     "aaaaaaaabbbbbbbbcccccccc",
+		},
+		{
+			comment: "global cap",
+			pool:    &memoryPool{limit: 12},
+			want:    "[16 bytes of output discarded]\ncccccccc",
+		},
+		{
+			comment:  "global cap with spill",
+			pool:     &memoryPool{limit: 12},
+			spillDir: spillDir,
+			want:     "aaaaaaaabbbbbbbbcccccccc",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			buf := newSyncBuffer(test.limit, test.pool, test.spillDir)
+			for _, s := range []string{"aaaaaaaa", "bbbbbbbb", "cccccccc"} {
+				buf.Write([]byte(s))
+			}
+
+			if got := buf.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if test.pool != nil && test.pool.used > test.pool.limit {
+				t.Errorf("pool holds %d bytes, want at most %d", test.pool.used, test.pool.limit)
+			}
+		})
+	}
+}
+
+func TestBufferFollowDiscarded(t *testing.T) {
+	buf := newSyncBuffer(8, nil, "")
+	buf.Write([]byte("aaaa"))
+
+	// A reader that has fallen behind the discarded output resumes after it.
+	data, off, _, _ := buf.readFrom(2)
+	if string(data) != "aa" {
+		t.Fatalf("got %q, want %q", data, "aa")
+	}
+	buf.Write([]byte(strings.Repeat("b", 12)))
+
+	data, off, _, _ = buf.readFrom(off)
+	if want := "[4 bytes of output discarded]\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+	data, _, _, _ = buf.readFrom(off)
+	if want := "bbbbbbbb"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+}
+
+func TestBufferRead(t *testing.T) {
+	spillDir, err := ioutil.TempDir("", "worker-test")
+	if err != nil {
+		t.Fatalf("Error creating spill directory: %v", err)
+	}
+	defer os.RemoveAll(spillDir)
+
+	var tests = []struct {
+		comment string
+		buf     *syncBuffer
+		r       OutputRange
+		want    OutputChunk
+	}{
+		{
+			comment: "everything",
+			buf:     newSyncBuffer(0, nil, ""),
+			want:    OutputChunk{Output: "one\ntwo\nthree\n", Next: 14, Size: 14},
+		},
+		{
+			comment: "offset and length",
+			buf:     newSyncBuffer(0, nil, ""),
+			r:       OutputRange{Offset: 4, Length: 3},
+			want:    OutputChunk{Output: "two", Offset: 4, Next: 7, Size: 14},
+		},
+		{
+			comment: "offset past the end",
+			buf:     newSyncBuffer(0, nil, ""),
+			r:       OutputRange{Offset: 20},
+			want:    OutputChunk{Offset: 20, Next: 20, Size: 14},
+		},
+		{
+			comment: "tail",
+			buf:     newSyncBuffer(0, nil, ""),
+			r:       OutputRange{Tail: 2},
+			want:    OutputChunk{Output: "two\nthree\n", Offset: 4, Next: 14, Size: 14},
+		},
+		{
+			comment: "tail of more lines than written",
+			buf:     newSyncBuffer(0, nil, ""),
+			r:       OutputRange{Tail: 5},
+			want:    OutputChunk{Output: "one\ntwo\nthree\n", Next: 14, Size: 14},
+		},
+		{
+			comment: "tail across spilled output",
+			buf:     newSyncBuffer(4, nil, spillDir),
+			r:       OutputRange{Tail: 2},
+			want:    OutputChunk{Output: "two\nthree\n", Offset: 4, Next: 14, Size: 14},
+		},
+		{
+			comment: "tail of discarded output",
+			buf:     newSyncBuffer(8, nil, ""),
+			r:       OutputRange{Tail: 3},
+			want:    OutputChunk{Output: "three\n", Offset: 8, Next: 14, Size: 14},
+		},
+		{
+			comment: "offset in discarded output",
+			buf:     newSyncBuffer(8, nil, ""),
+			r:       OutputRange{Offset: 2},
+			want:    OutputChunk{Output: "[4 bytes of output discarded]\no\nthree\n", Offset: 2, Next: 14, Size: 14},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			for _, s := range []string{"one\n", "two\n", "three\n"} {
+				test.buf.Write([]byte(s))
+			}
+
+			if got := test.buf.read(test.r); got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBufferReadLength(t *testing.T) {
+	buf := newSyncBuffer(0, nil, "")
+	buf.Write(bytes.Repeat([]byte("x"), MaxReadLength+10))
+
+	var tests = []struct {
+		comment string
+		r       OutputRange
+		next    int64
+	}{
+		{comment: "default length", r: OutputRange{}, next: MaxReadLength},
+		{comment: "length over the maximum", r: OutputRange{Length: MaxReadLength + 5}, next: MaxReadLength},
+		{comment: "remainder", r: OutputRange{Offset: MaxReadLength}, next: MaxReadLength + 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			chunk := buf.read(test.r)
+			if chunk.Next != test.next || int64(len(chunk.Output)) != test.next-test.r.Offset {
+				t.Errorf("got %d bytes up to %d, want up to %d", len(chunk.Output), chunk.Next, test.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package worker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroup2SuperMagic identifies a cgroup v2 filesystem (see statfs(2)).
+const cgroup2SuperMagic = 0x63677270
+
+// cpuPeriod is the scheduling period, in microseconds, used to express CPU quotas.
+const cpuPeriod = 100000
+
+// controllers lists the cgroup v2 controllers delegated to job cgroups.
+var controllers = []string{"cpu", "memory", "io"}
+
+// A cgroup is the cgroup v2 directory dedicated to a single job.
+type cgroup struct {
+	path string
+}
+
+// setupCgroupParent creates the given parent cgroup if necessary and delegates
+// the controllers required by job limits to its children.
+func setupCgroupParent(parent string) error {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(filepath.Dir(parent), &fs)
+	if err != nil {
+		return err
+	}
+	if fs.Type != cgroup2SuperMagic {
+		return fmt.Errorf("%s is not on a cgroup v2 filesystem", parent)
+	}
+
+	err = os.MkdirAll(parent, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Controllers must be enabled at every level between the cgroup root and
+	// the job cgroups, so enable them in the parent's parent as well. Missing
+	// controllers are skipped; jobs that need them fail when their limits are
+	// applied.
+	for _, dir := range []string{filepath.Dir(parent), parent} {
+		available, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+		if err != nil {
+			return err
+		}
+		for _, c := range controllers {
+			if !hasField(string(available), c) {
+				continue
+			}
+			err = writeCgroupFile(dir, "cgroup.subtree_control", "+"+c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasField(s, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// newCgroup creates a cgroup for the job with the given id beneath parent and
+// applies the given limits to it.
+func newCgroup(parent, id string, limits Limits) (*cgroup, error) {
+	cg := &cgroup{path: filepath.Join(parent, id)}
+
+	err := os.Mkdir(cg.path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cg.apply(limits)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+func (cg *cgroup) apply(limits Limits) error {
+	if limits.CPUWeight > 0 {
+		err := writeCgroupFile(cg.path, "cpu.weight", strconv.FormatUint(limits.CPUWeight, 10))
+		if err != nil {
+			return err
+		}
+	}
+	if limits.CPUQuota > 0 {
+		quota := int64(limits.CPUQuota * cpuPeriod)
+		err := writeCgroupFile(cg.path, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod))
+		if err != nil {
+			return err
+		}
+	}
+	if limits.MemoryMax > 0 {
+		err := writeCgroupFile(cg.path, "memory.max", strconv.FormatInt(limits.MemoryMax, 10))
+		if err != nil {
+			return err
+		}
+		// Without swap the memory limit could be sidestepped by paging out.
+		err = writeCgroupFile(cg.path, "memory.swap.max", "0")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, io := range limits.IO {
+		line := io.Device
+		if io.ReadBPS > 0 {
+			line += fmt.Sprintf(" rbps=%d", io.ReadBPS)
+		}
+		if io.WriteBPS > 0 {
+			line += fmt.Sprintf(" wbps=%d", io.WriteBPS)
+		}
+		err := writeCgroupFile(cg.path, "io.max", line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// procsFile returns the path a process writes its pid to in order to join the cgroup.
+func (cg *cgroup) procsFile() string {
+	return filepath.Join(cg.path, "cgroup.procs")
+}
+
+// oomKilled reports whether the kernel OOM killer has terminated a process in
+// the cgroup because of its memory limit.
+func (cg *cgroup) oomKilled() bool {
+	f, err := os.Open(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n > 0
+		}
+	}
+
+	return false
+}
+
+// removeCgroup removes the cgroup of the job with the given id beneath parent, if
+// it still exists, as described by cgroup.remove.
+func removeCgroup(parent, id string) error {
+	cg := &cgroup{path: filepath.Join(parent, id)}
+	return cg.remove()
+}
+
+// remove kills any processes left in the cgroup and deletes it.
+func (cg *cgroup) remove() error {
+	// cgroup.kill is only available on Linux 5.14+. On older kernels, any
+	// descendants that outlived the job keep the cgroup busy.
+	writeCgroupFile(cg.path, "cgroup.kill", "1")
+
+	var err error
+	for i := 0; i < 10; i++ {
+		err = os.Remove(cg.path)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return err
+}
+
+func writeCgroupFile(dir, file, data string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(data), 0644)
+}
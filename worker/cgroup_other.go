@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+import "errors"
+
+var errCgroupsUnsupported = errors.New("cgroups are only supported on Linux")
+
+// A cgroup is a placeholder on platforms without cgroup support.
+type cgroup struct{}
+
+func setupCgroupParent(parent string) error { return errCgroupsUnsupported }
+
+func newCgroup(parent, id string, limits Limits) (*cgroup, error) {
+	return nil, errCgroupsUnsupported
+}
+
+func removeCgroup(parent, id string) error { return nil }
+
+func (cg *cgroup) oomKilled() bool { return false }
+
+func (cg *cgroup) remove() error { return nil }
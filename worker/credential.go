@@ -0,0 +1,85 @@
+package worker
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// A credential is the numeric identity a process runs as.
+type credential struct {
+	Uid    uint32   `json:"uid"`
+	Gid    uint32   `json:"gid"`
+	Groups []uint32 `json:"groups"`
+}
+
+// lookupCredential resolves the given user and group, either of which may be a name
+// or a numeric id. If only a user is given, the process runs with that user's primary
+// and supplementary groups. If only a group is given, the process keeps the worker's
+// user. It returns nil if neither is given.
+func lookupCredential(username, groupname string) (*credential, error) {
+	if len(username) == 0 && len(groupname) == 0 {
+		return nil, nil
+	}
+
+	cred := &credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	if len(username) > 0 {
+		u, err := user.Lookup(username)
+		if err != nil {
+			u, err = user.LookupId(username)
+		}
+		if err != nil {
+			return nil, &ErrInvalidJob{"unknown user " + username}
+		}
+
+		cred.Uid, err = parseId(u.Uid)
+		if err != nil {
+			return nil, err
+		}
+		cred.Gid, err = parseId(u.Gid)
+		if err != nil {
+			return nil, err
+		}
+
+		groupIds, err := u.GroupIds()
+		if err == nil {
+			for _, g := range groupIds {
+				gid, err := parseId(g)
+				if err != nil {
+					return nil, err
+				}
+				cred.Groups = append(cred.Groups, gid)
+			}
+		}
+	}
+
+	if len(groupname) > 0 {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			g, err = user.LookupGroupId(groupname)
+		}
+		if err != nil {
+			return nil, &ErrInvalidJob{"unknown group " + groupname}
+		}
+
+		cred.Gid, err = parseId(g.Gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cred, nil
+}
+
+func parseId(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, &ErrInvalidJob{"users and groups are not supported on this platform"}
+	}
+
+	return uint32(n), nil
+}
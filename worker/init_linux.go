@@ -0,0 +1,267 @@
+package worker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// Processes are not started directly. Instead the binary embedding this package
+// re-executes itself as a small init process, which prepares the environment of
+// the job from the inside (e.g. joining its cgroup) and then replaces itself with
+// the job's command. This guarantees that the command never runs a single
+// instruction outside of the constraints set up for it. When the job is isolated,
+// the init process is also the first process of the new namespaces. It then stays
+// behind as PID 1, which the kernel shields from signals it has no handler for, and
+// runs the command as its child instead, reaping any orphans until the command ends.
+
+const (
+	initArg0      = "worker-init"
+	initConfigEnv = "_WORKER_INIT_CONFIG"
+
+	// initErrFd is the file descriptor the init process reports setup failures on.
+	// It is closed on exec, so reading EOF from it means the command is running.
+	initErrFd = 3
+	// initStatusFd is the file descriptor an isolated init process reports the wait
+	// status of the command on, since it cannot itself be killed by the signal that
+	// killed the command.
+	initStatusFd = 4
+)
+
+// initConfig describes the work the init process must do before executing a job.
+type initConfig struct {
+	Path   string   `json:"path"`
+	Args   []string `json:"args"`
+	Cgroup string   `json:"cgroup,omitempty"` // cgroup.procs file to join.
+
+	// Namespace setup, only valid if the process was cloned into new namespaces.
+	Isolated bool   `json:"isolated,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Loopback bool   `json:"loopback,omitempty"` // Bring up the loopback interface.
+
+	// Credential is applied last, since the steps above require privileges.
+	Credential *credential `json:"credential,omitempty"`
+}
+
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == initArg0 {
+		runInit()
+	}
+}
+
+// runInit prepares the current process for the job described in its environment
+// and executes it. It never returns.
+func runInit() {
+	errPipe := os.NewFile(initErrFd, "errpipe")
+	syscall.CloseOnExec(initErrFd)
+
+	fail := func(err error) {
+		fmt.Fprint(errPipe, err)
+		os.Exit(1)
+	}
+
+	var config initConfig
+	err := json.Unmarshal([]byte(os.Getenv(initConfigEnv)), &config)
+	if err != nil {
+		fail(fmt.Errorf("invalid init config: %v", err))
+	}
+	os.Unsetenv(initConfigEnv)
+
+	if config.Cgroup != "" {
+		err = ioutil.WriteFile(config.Cgroup, []byte(fmt.Sprint(os.Getpid())), 0644)
+		if err != nil {
+			fail(fmt.Errorf("joining cgroup: %v", err))
+		}
+	}
+
+	if config.Isolated {
+		err = setupNamespaces(config)
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	if config.Credential != nil {
+		err = setIdentity(config.Credential)
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	if config.Isolated {
+		superviseCommand(config, errPipe, fail)
+	}
+
+	err = syscall.Exec(config.Path, config.Args, os.Environ())
+	fail(err)
+}
+
+// superviseCommand runs the command as a child of the init process, which is PID 1
+// of its namespace, and exits like the command once it ends. It never returns.
+func superviseCommand(config initConfig, errPipe *os.File, fail func(error)) {
+	statusPipe := os.NewFile(initStatusFd, "statuspipe")
+	syscall.CloseOnExec(initStatusFd)
+
+	// Handle every signal, since the Go runtime exits on some by default. The
+	// command shares the process group of the init process, so the signals sent
+	// to the group reach it directly.
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals)
+
+	pid, err := syscall.ForkExec(config.Path, config.Args, &syscall.ProcAttr{
+		Env:   os.Environ(),
+		Files: []uintptr{0, 1, 2},
+	})
+	if err != nil {
+		fail(err)
+	}
+	errPipe.Close()
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGCHLD || sig == syscall.SIGURG {
+				continue
+			}
+			// Forward the signal if the command has moved to a process group of its
+			// own (e.g. an interactive shell), where it would otherwise miss it.
+			if pgid, err := syscall.Getpgid(pid); err == nil && pgid != syscall.Getpgrp() {
+				syscall.Kill(pid, sig.(syscall.Signal))
+			}
+		}
+	}()
+
+	for {
+		var ws syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if err == syscall.EINTR || (err == nil && wpid != pid) {
+			// An orphan was reaped.
+			continue
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+
+		binary.Write(statusPipe, binary.LittleEndian, uint32(ws))
+		if ws.Signaled() {
+			os.Exit(128 + int(ws.Signal()))
+		}
+		os.Exit(ws.ExitStatus())
+	}
+}
+
+// setIdentity switches the calling process to the given credential.
+func setIdentity(cred *credential) error {
+	groups := make([]int, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = int(g)
+	}
+
+	err := syscall.Setgroups(groups)
+	if err != nil {
+		return fmt.Errorf("setting groups: %v", err)
+	}
+	err = syscall.Setgid(int(cred.Gid))
+	if err != nil {
+		return fmt.Errorf("setting gid: %v", err)
+	}
+	err = syscall.Setuid(int(cred.Uid))
+	if err != nil {
+		return fmt.Errorf("setting uid: %v", err)
+	}
+
+	return nil
+}
+
+// startCommand starts cmd by way of the init process, placing it in the given
+// cgroup (if any) and the namespaces requested by the job, and switching to the
+// given credential (if any), before the command itself is executed. It returns a
+// function reporting how the command ended once cmd has been waited for.
+func startCommand(cmd *exec.Cmd, id string, job Job, cg *cgroup, cred *credential) (func() *syscall.WaitStatus, error) {
+	config := initConfig{
+		Path:       cmd.Path,
+		Args:       cmd.Args,
+		Credential: cred,
+	}
+	if cg != nil {
+		config.Cgroup = cg.procsFile()
+	}
+	if job.Isolation != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Cloneflags = cloneFlags(job.Isolation)
+		config.Isolated = true
+		config.Hostname = id
+		config.Loopback = !job.Isolation.HostNetwork
+	}
+
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	errRead, errWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer errRead.Close()
+	cmd.ExtraFiles = []*os.File{errWrite}
+
+	var statusRead, statusWrite *os.File
+	if config.Isolated {
+		statusRead, statusWrite, err = os.Pipe()
+		if err != nil {
+			errWrite.Close()
+			return nil, err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, statusWrite)
+	}
+
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{initArg0}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, initConfigEnv+"="+string(encoded))
+
+	err = cmd.Start()
+	errWrite.Close()
+	if statusWrite != nil {
+		statusWrite.Close()
+	}
+	if err == nil {
+		msg, _ := ioutil.ReadAll(errRead)
+		if len(msg) > 0 {
+			cmd.Wait()
+			err = fmt.Errorf("%s", msg)
+		}
+	}
+	if err != nil {
+		if statusRead != nil {
+			statusRead.Close()
+		}
+		return nil, err
+	}
+
+	if statusRead == nil {
+		return func() *syscall.WaitStatus { return waitStatus(cmd) }, nil
+	}
+
+	return func() *syscall.WaitStatus {
+		defer statusRead.Close()
+
+		// The init process reports nothing if it was killed itself.
+		var ws uint32
+		err := binary.Read(statusRead, binary.LittleEndian, &ws)
+		if err != nil {
+			return waitStatus(cmd)
+		}
+		status := syscall.WaitStatus(ws)
+		return &status
+	}, nil
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// startCommand starts cmd directly, since no further setup is supported. It
+// returns a function reporting how the command ended once cmd has been waited for.
+func startCommand(cmd *exec.Cmd, id string, job Job, cg *cgroup, cred *credential) (func() *syscall.WaitStatus, error) {
+	if job.Isolation != nil {
+		return nil, errors.New("isolation is only supported on Linux")
+	}
+	if cred != nil {
+		err := setCredential(cmd, cred)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() *syscall.WaitStatus { return waitStatus(cmd) }, nil
+}
@@ -0,0 +1,162 @@
+package worker
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// killTimeout is how long Kill waits for a process to be reaped after SIGKILL.
+const killTimeout = 5 * time.Second
+
+// KillOptions controls how Kill terminates a process.
+type KillOptions struct {
+	// Signal is sent to the process group first. The default is SIGTERM.
+	Signal syscall.Signal
+	// Grace is how long the process group is given to exit after Signal before
+	// being sent SIGKILL. The default is set by WithKillGrace.
+	Grace time.Duration
+}
+
+// Kill terminates the process represented by the given id, along with all of the
+// processes in its process group. The group is sent opts.Signal, and if the process
+// has not exited after the grace period, SIGKILL. Kill returns once the process has
+// been reaped. A process that has yet to start, e.g. because it is queued, never
+// does.
+func (w *Worker) Kill(id string, opts KillOptions) error {
+	p, done, err := w.log.cancelStart(id)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		return w.terminate(id, opts, StateKilled)
+	}
+
+	// The job is marked as killed, so if the queue admits it in the meantime, it
+	// ends before its process starts (see Run and execJob). Otherwise it is still
+	// waiting, and ends here.
+	if w.queue.remove(id) {
+		w.cancel(id)
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(killTimeout):
+		return errors.New("job not killed before timeout")
+	}
+}
+
+// cancel records that the process represented by the given id was killed before it
+// started.
+func (w *Worker) cancel(id string) error {
+	output, err := w.log.getOutput(id)
+	if err != nil {
+		return err
+	}
+	// As in execJob, the output is closed once the final status has been set.
+	defer output.Close()
+
+	return w.log.updateStatus(id, func(status *Status) {
+		now := time.Now()
+		status.State = StateKilled
+		status.Finished = &now
+	})
+}
+
+// terminate stops a process as described by Kill, and sets its final state to the
+// given state.
+func (w *Worker) terminate(id string, opts KillOptions, state State) error {
+	p, err := w.log.getProcess(id)
+	if err != nil {
+		return err
+	}
+
+	sig := opts.Signal
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	grace := opts.Grace
+	if grace == 0 {
+		grace = w.killGrace
+	}
+
+	// Set the final state before signalling the process, so that it is in place
+	// by the time the process is reaped. Only one termination may do so.
+	var previous State
+	var notActive error
+	err = w.log.updateStatus(id, func(status *Status) {
+		if status.Done() {
+			notActive = &ErrJobNotActive{"job not active"}
+			return
+		}
+		previous = status.State
+		status.State = state
+	})
+	if err == nil {
+		err = notActive
+	}
+	if err != nil {
+		return err
+	}
+
+	if sig != syscall.SIGKILL {
+		err = signalGroup(p.pid, sig)
+		if err == nil && previous == StatePaused {
+			// A stopped process only handles the signal once it is resumed.
+			err = signalGroup(p.pid, resumeSignal)
+		}
+		if err != nil {
+			w.log.updateStatus(id, func(status *Status) {
+				if status.Finished == nil {
+					status.State = previous
+				}
+			})
+			return err
+		}
+
+		select {
+		case <-p.done:
+			return nil
+		case <-time.After(grace):
+		}
+	}
+
+	err = signalGroup(p.pid, syscall.SIGKILL)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(killTimeout):
+		return errors.New("job not killed before timeout")
+	}
+}
+
+// Signal sends sig to the process group of the process represented by the given id.
+// Stopping the process with SIGSTOP (or another stop signal) pauses it until it is
+// resumed with SIGCONT.
+func (w *Worker) Signal(id string, sig syscall.Signal) error {
+	p, err := w.log.getProcess(id)
+	if err != nil {
+		return err
+	}
+
+	err = signalGroup(p.pid, sig)
+	if err != nil {
+		return err
+	}
+
+	return w.log.updateStatus(id, func(status *Status) {
+		if status.Done() {
+			return
+		}
+		if pauseSignals[sig] {
+			status.State = StatePaused
+		} else if sig == resumeSignal {
+			status.State = StateActive
+		}
+	})
+}
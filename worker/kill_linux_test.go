@@ -0,0 +1,207 @@
+package worker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKill(t *testing.T) {
+	w := NewWorker()
+
+	var tests = []struct {
+		comment string
+		script  string
+		opts    KillOptions
+		signal  string
+	}{
+		{
+			comment: "process exits on SIGTERM",
+			script:  "sleep 100 & echo $!; wait",
+			opts:    KillOptions{},
+			signal:  "SIGTERM",
+		},
+		{
+			comment: "process ignoring SIGTERM is killed after the grace period",
+			script:  "trap '' TERM; sleep 100 & echo $!; while true; do sleep 0.1; done",
+			opts:    KillOptions{Grace: 200 * time.Millisecond},
+			signal:  "SIGKILL",
+		},
+		{
+			comment: "process receives the requested signal",
+			script:  "sleep 100 & echo $!; wait",
+			opts:    KillOptions{Signal: syscall.SIGHUP},
+			signal:  "SIGHUP",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			id, err := w.Run(Job{Command: "sh", Args: []string{"-c", test.script}})
+			if err != nil {
+				t.Fatalf("Error running job: %v", err)
+			}
+
+			// The job prints the pid of the child it started in the background.
+			var out string
+			for i := 0; i < 50 && !strings.HasSuffix(out, "\n"); i++ {
+				time.Sleep(20 * time.Millisecond)
+				out, _ = w.Out(id, StreamStdout)
+			}
+			child, err := strconv.Atoi(strings.TrimSpace(out))
+			if err != nil {
+				t.Fatalf("Error reading child pid: %v", err)
+			}
+
+			err = w.Kill(id, test.opts)
+			if err != nil {
+				t.Fatalf("Error killing job: %v", err)
+			}
+
+			status, _ := w.Status(id)
+			if status.State != StateKilled || status.Signal != test.signal {
+				t.Errorf("got %s, want killed (%s)", status, test.signal)
+			}
+			if processRunning(child) {
+				t.Errorf("child process %d still running", child)
+			}
+
+			err = w.Kill(id, test.opts)
+			if _, ok := err.(*ErrJobNotActive); !ok {
+				t.Errorf("got %v killing job twice, want ErrJobNotActive", err)
+			}
+		})
+	}
+}
+
+func TestKillIsolated(t *testing.T) {
+	if syscall.Geteuid() != 0 {
+		t.Skip("isolating processes requires root")
+	}
+
+	grace := 5 * time.Second
+	w := NewWorker(WithKillGrace(grace))
+
+	id, err := w.Run(Job{Command: "sleep", Args: []string{"100"}, Isolation: &Isolation{}})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if status, _ := w.Status(id); status.Started != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The command is not PID 1 of its namespace, so it is not shielded from SIGTERM.
+	start := time.Now()
+	err = w.Kill(id, KillOptions{})
+	if err != nil {
+		t.Fatalf("Error killing job: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= grace {
+		t.Errorf("kill took %v, want less than the grace period", elapsed)
+	}
+
+	status, _ := w.Status(id)
+	if status.State != StateKilled || status.Signal != "SIGTERM" {
+		t.Errorf("got %s, want killed (SIGTERM)", status)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	w := NewWorker()
+
+	id, err := w.Run(Job{Command: "sleep", Args: []string{"100"}})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	defer w.Kill(id, KillOptions{Signal: syscall.SIGKILL})
+
+	var p *process
+	for i := 0; i < 50 && p == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		p, _ = w.log.getProcess(id)
+	}
+
+	var tests = []struct {
+		signal    syscall.Signal
+		state     State
+		procState string
+	}{
+		{signal: syscall.SIGSTOP, state: StatePaused, procState: "T"},
+		{signal: syscall.SIGCONT, state: StateActive, procState: "S"},
+	}
+
+	for _, test := range tests {
+		t.Run(signalName(test.signal), func(t *testing.T) {
+			err := w.Signal(id, test.signal)
+			if err != nil {
+				t.Fatalf("Error signalling job: %v", err)
+			}
+
+			status, _ := w.Status(id)
+			if status.State != test.state {
+				t.Errorf("got state %q, want %q", status.State, test.state)
+			}
+
+			time.Sleep(50 * time.Millisecond)
+			if got := processState(p.pid); got != test.procState {
+				t.Errorf("got process state %q, want %q", got, test.procState)
+			}
+		})
+	}
+}
+
+// processRunning returns true if the process with the given pid exists and is not
+// a zombie waiting to be reaped by its new parent.
+func processRunning(pid int) bool {
+	state := processState(pid)
+	return len(state) > 0 && state != "Z"
+}
+
+// processState returns the state of the process with the given pid as reported in
+// /proc, e.g. "S" for sleeping, or an empty string if there is no such process.
+func processState(pid int) string {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+
+	// The state follows the parenthesized command name.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return fields[0]
+}
+
+func TestParseSignal(t *testing.T) {
+	var tests = []struct {
+		name  string
+		want  syscall.Signal
+		valid bool
+	}{
+		{name: "SIGTERM", want: syscall.SIGTERM, valid: true},
+		{name: "usr1", want: syscall.SIGUSR1, valid: true},
+		{name: "9", want: syscall.SIGKILL, valid: true},
+		{name: "SIGNOPE", valid: false},
+		{name: "0", valid: false},
+		{name: "-9", valid: false},
+		{name: "999", valid: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sig, err := ParseSignal(test.name)
+			if (err == nil) != test.valid || sig != test.want {
+				t.Errorf("got %v (error %v), want %v (valid %t)", sig, err, test.want, test.valid)
+			}
+		})
+	}
+}
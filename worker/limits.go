@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"regexp"
+)
+
+// maxCPUWeight is the largest value accepted by the cgroup v2 cpu.weight file.
+const maxCPUWeight = 10000
+
+var deviceMatch = regexp.MustCompile(`^[0-9]+:[0-9]+$`)
+
+// Limits restricts the resources available to a job. A zero value in any field
+// leaves the corresponding resource unrestricted.
+type Limits struct {
+	// CPUWeight is the job's relative share of CPU time, from 1 to 10000
+	// (the kernel default is 100).
+	CPUWeight uint64 `json:"cpu_weight,omitempty"`
+	// CPUQuota caps the CPU time of the job as a number of CPUs, e.g. 0.5 for
+	// half of one CPU.
+	CPUQuota float64 `json:"cpu_quota,omitempty"`
+	// MemoryMax caps the memory usage of the job in bytes. Jobs exceeding it are
+	// killed by the kernel OOM killer.
+	MemoryMax int64 `json:"memory_max,omitempty"`
+	// IO caps the bandwidth of the job per block device.
+	IO []IOLimit `json:"io,omitempty"`
+}
+
+// IOLimit caps the bandwidth a job may use on a single block device.
+type IOLimit struct {
+	Device   string `json:"device"` // In "major:minor" form, e.g. "8:0".
+	ReadBPS  uint64 `json:"read_bps,omitempty"`
+	WriteBPS uint64 `json:"write_bps,omitempty"`
+}
+
+// isZero returns true if no limit has been set.
+func (l Limits) isZero() bool {
+	return l.CPUWeight == 0 && l.CPUQuota == 0 && l.MemoryMax == 0 && len(l.IO) == 0
+}
+
+func (l Limits) validate() error {
+	if l.CPUWeight > maxCPUWeight {
+		return &ErrInvalidJob{"cpu weight must be between 1 and 10000"}
+	}
+	if l.CPUQuota < 0 {
+		return &ErrInvalidJob{"cpu quota must not be negative"}
+	}
+	if l.MemoryMax < 0 {
+		return &ErrInvalidJob{"memory limit must not be negative"}
+	}
+	for _, io := range l.IO {
+		if !deviceMatch.MatchString(io.Device) {
+			return &ErrInvalidJob{"io device must be in major:minor form"}
+		}
+		if io.ReadBPS == 0 && io.WriteBPS == 0 {
+			return &ErrInvalidJob{"io limit for " + io.Device + " sets no bandwidth"}
+		}
+	}
+
+	return nil
+}
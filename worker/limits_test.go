@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLimitsValidation(t *testing.T) {
+	var tests = []struct {
+		comment string
+		limits  Limits
+		valid   bool
+	}{
+		{
+			comment: "no limits",
+			limits:  Limits{},
+			valid:   true,
+		},
+		{
+			comment: "all limits within range",
+			limits: Limits{
+				CPUWeight: 200,
+				CPUQuota:  0.5,
+				MemoryMax: 64 << 20,
+				IO:        []IOLimit{{Device: "8:0", ReadBPS: 1 << 20}},
+			},
+			valid: true,
+		},
+		{
+			comment: "cpu weight out of range",
+			limits:  Limits{CPUWeight: 10001},
+			valid:   false,
+		},
+		{
+			comment: "negative memory limit",
+			limits:  Limits{MemoryMax: -1},
+			valid:   false,
+		},
+		{
+			comment: "malformed io device",
+			limits:  Limits{IO: []IOLimit{{Device: "sda", WriteBPS: 1}}},
+			valid:   false,
+		},
+		{
+			comment: "io limit without bandwidth",
+			limits:  Limits{IO: []IOLimit{{Device: "8:0"}}},
+			valid:   false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			err := test.limits.validate()
+			if (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestLimitsCgroupParent(t *testing.T) {
+	// The parent is not on a cgroup filesystem, so no cgroup can be created in it.
+	dir, err := ioutil.TempDir("", "worker")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewWorker(WithLimitsCgroupParent(dir))
+
+	var tests = []struct {
+		comment string
+		limits  Limits
+		state   State
+	}{
+		{
+			comment: "job without limits runs outside of a cgroup",
+			limits:  Limits{},
+			state:   StateComplete,
+		},
+		{
+			comment: "job with limits requires a cgroup",
+			limits:  Limits{CPUWeight: 100},
+			state:   StateError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			id, err := w.Run(Job{Command: "true", Limits: test.limits})
+			if err != nil {
+				t.Fatalf("Error running job: %v", err)
+			}
+
+			status := waitForJob(t, w, id)
+			if status.State != test.state {
+				t.Errorf("got state %q, want %q", status.State, test.state)
+			}
+		})
+	}
+}
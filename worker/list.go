@@ -0,0 +1,183 @@
+package worker
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultListLimit is the number of jobs List returns if no limit is given.
+	DefaultListLimit = 100
+	// MaxListLimit is the largest number of jobs List returns at once.
+	MaxListLimit = 1000
+)
+
+// A JobInfo describes a job and its current status.
+type JobInfo struct {
+	ID      string            `json:"id"`
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Status  Status            `json:"status"`
+}
+
+// ListOptions selects the jobs returned by List. Filters left unset match every
+// job, and jobs must match all the filters that are set.
+type ListOptions struct {
+	State State
+	// Command matches jobs whose command, or its base name, is equal to it.
+	Command       string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// Labels holds selectors in "key=value" form, matching jobs with that label,
+	// or "key" form, matching jobs with that label whatever its value.
+	Labels []string
+	// Allow, if set, is called to decide whether the job with the given id may be
+	// listed, e.g. based on who owns it.
+	Allow func(id string) bool
+
+	// Cursor continues a previous listing from where it stopped (see JobList).
+	Cursor string
+	// Limit is the most jobs to return, DefaultListLimit if zero. It is capped at
+	// MaxListLimit.
+	Limit int
+}
+
+// A JobList is a page of jobs returned by List, most recently created first.
+type JobList struct {
+	Jobs []JobInfo `json:"jobs"`
+	// Next, if set, is the cursor from which to list the following jobs.
+	Next string `json:"next,omitempty"`
+}
+
+// ErrInvalidCursor occurs when a listing is continued from an invalid cursor.
+type ErrInvalidCursor struct{ msg string }
+
+func (e *ErrInvalidCursor) Error() string { return e.msg }
+
+// List returns the jobs selected by opts.
+func (w *Worker) List(opts ListOptions) (JobList, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	var after *listPosition
+	if len(opts.Cursor) > 0 {
+		pos, err := parseCursor(opts.Cursor)
+		if err != nil {
+			return JobList{}, err
+		}
+		after = &pos
+	}
+
+	jobs := w.log.list(func(info JobInfo) bool {
+		if after != nil && !after.before(info) {
+			return false
+		}
+		return opts.matches(info)
+	})
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return positionOf(jobs[i]).before(jobs[j])
+	})
+
+	var list JobList
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+		list.Next = positionOf(jobs[limit-1]).cursor()
+	}
+	positions := w.queue.positions()
+	for i := range jobs {
+		buf, err := w.log.getOutputBuffer(jobs[i].ID, StreamCombined)
+		if err == nil {
+			jobs[i].Status.OutputSize = buf.len()
+		}
+		if jobs[i].Status.State == StateQueued {
+			jobs[i].Status.QueuePosition = positions[jobs[i].ID]
+		}
+	}
+	list.Jobs = jobs
+
+	return list, nil
+}
+
+// matches returns true if the job matches the filters of opts.
+func (opts ListOptions) matches(info JobInfo) bool {
+	if len(opts.State) > 0 && info.Status.State != opts.State {
+		return false
+	}
+	if len(opts.Command) > 0 && info.Command != opts.Command && filepath.Base(info.Command) != opts.Command {
+		return false
+	}
+	if opts.CreatedAfter != nil && !info.Status.Created.After(*opts.CreatedAfter) {
+		return false
+	}
+	if opts.CreatedBefore != nil && !info.Status.Created.Before(*opts.CreatedBefore) {
+		return false
+	}
+	for _, selector := range opts.Labels {
+		keyValue := strings.SplitN(selector, "=", 2)
+		value, ok := info.Labels[keyValue[0]]
+		if !ok || (len(keyValue) == 2 && value != keyValue[1]) {
+			return false
+		}
+	}
+	if opts.Allow != nil && !opts.Allow(info.ID) {
+		return false
+	}
+
+	return true
+}
+
+// A listPosition is the position of a job in the order of List.
+type listPosition struct {
+	created time.Time
+	id      string
+}
+
+func positionOf(info JobInfo) listPosition {
+	return listPosition{created: info.Status.Created, id: info.ID}
+}
+
+// before returns true if the job at the position is listed before the given job,
+// i.e. if the given job was created earlier, or at the same time with a smaller id.
+func (p listPosition) before(info JobInfo) bool {
+	if !p.created.Equal(info.Status.Created) {
+		return p.created.After(info.Status.Created)
+	}
+	return p.id > info.ID
+}
+
+// cursor encodes the position as an opaque string.
+func (p listPosition) cursor() string {
+	raw := strconv.FormatInt(p.created.UnixNano(), 10) + ":" + p.id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(cursor string) (listPosition, error) {
+	invalid := &ErrInvalidCursor{fmt.Sprintf("invalid cursor %q", cursor)}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return listPosition{}, invalid
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return listPosition{}, invalid
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return listPosition{}, invalid
+	}
+
+	return listPosition{created: time.Unix(0, nanos), id: parts[1]}, nil
+}
@@ -1,41 +1,47 @@
 package worker
 
 import (
-	"bytes"
+	stdlog "log"
 	"sync"
+	"time"
 )
 
-type syncBuffer struct {
-	mu sync.RWMutex
-	b  bytes.Buffer
-}
-
-func (s *syncBuffer) Write(p []byte) (n int, err error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	return s.b.Write(p)
-}
-
-func (s *syncBuffer) String() string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	return s.b.String()
-}
-
 // A log contains information about Linux processes being executed by the worker
 // library. Use newLog to create a new instance.
 type log struct {
 	entries map[string]*logEntry
 	mu      sync.RWMutex
+	// store, if set, is kept up to date with the status of every entry.
+	store Store
 }
 
 // A logEntry contains data relevant to a single Linux process.
 type logEntry struct {
-	status       string
-	outputBuffer *syncBuffer
-	killC        chan bool
+	command string
+	args    []string
+	labels  map[string]string
+
+	status  Status
+	done    chan struct{} // Closed once the final status has been set.
+	output  *output
+	process *process // Set once the process has started.
+	stdin   *stdinPipe
+	tty     *terminal
+
+	// The status is saved in the store without holding the log's lock. version
+	// counts the updates of the status, and saveMu guards the version last saved,
+	// so that an update is never overwritten by an earlier one, nor saved once the
+	// job has been removed.
+	version      uint64
+	saveMu       sync.Mutex
+	savedVersion uint64
+	removed      bool
+}
+
+// A process is the running process of a job.
+type process struct {
+	pid  int
+	done chan struct{} // Closed once the process has been reaped.
 }
 
 // newLog creates a new instance of the process log.
@@ -45,11 +51,101 @@ func newLog() *log {
 	}
 }
 
-func (log *log) addEntry(id string) {
+func (log *log) addEntry(id string, job Job, state State, output *output) error {
+	entry := &logEntry{
+		command: job.Command,
+		args:    job.Args,
+		labels:  job.Labels,
+		status:  Status{State: state, Created: time.Now()},
+		done:    make(chan struct{}),
+		output:  output,
+	}
+	// The entry is only added once saved, so there can be no updates to save yet.
+	if log.store != nil {
+		err := log.store.SaveJob(entry.info(id))
+		if err != nil {
+			return err
+		}
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	log.entries[id] = entry
+	return nil
+}
+
+// restoreEntry adds an entry for a job restored from the store, which has ended.
+func (log *log) restoreEntry(info JobInfo, output *output) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	done := make(chan struct{})
+	close(done)
+
+	log.entries[info.ID] = &logEntry{
+		command: info.Command,
+		args:    info.Args,
+		labels:  info.Labels,
+		status:  info.Status,
+		done:    done,
+		output:  output,
+	}
+}
+
+// info summarizes the entry of the job with the given id.
+func (entry *logEntry) info(id string) JobInfo {
+	return JobInfo{
+		ID:      id,
+		Command: entry.command,
+		Args:    entry.args,
+		Labels:  entry.labels,
+		Status:  entry.status,
+	}
+}
+
+// removeEntry removes the entry of a job that has ended and returns it. A job that
+// has been killed or has timed out but whose process has not been reaped yet, e.g.
+// during its grace period, has not ended.
+func (log *log) removeEntry(id string) (*logEntry, error) {
 	log.mu.Lock()
 	defer log.mu.Unlock()
 
-	log.entries[id] = &logEntry{status: statusActive, outputBuffer: &syncBuffer{}}
+	entry, err := log.getEntryLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	if entry.status.Finished == nil {
+		return nil, &ErrJobActive{"job still active"}
+	}
+
+	delete(log.entries, id)
+	return entry, nil
+}
+
+// stopSaving waits for any status of the entry being saved to the store, and keeps
+// it from saving any more, so that the job can be deleted from the store.
+func (entry *logEntry) stopSaving() {
+	entry.saveMu.Lock()
+	defer entry.saveMu.Unlock()
+
+	entry.removed = true
+}
+
+// list returns the jobs of all entries for which match returns true.
+func (log *log) list(match func(info JobInfo) bool) []JobInfo {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+
+	jobs := []JobInfo{}
+	for id, entry := range log.entries {
+		info := entry.info(id)
+		if match(info) {
+			jobs = append(jobs, info)
+		}
+	}
+
+	return jobs
 }
 
 func (log *log) getEntryLocked(id string) (*logEntry, error) {
@@ -61,32 +157,116 @@ func (log *log) getEntryLocked(id string) (*logEntry, error) {
 	return entry, nil
 }
 
-func (log *log) setStatus(id, status string) error {
+// updateStatus applies the given update to the status of an entry while holding
+// the log's lock. The store is updated too once the lock is released, on a
+// best-effort basis: failing to save the status of a running job is no reason to
+// stop it.
+func (log *log) updateStatus(id string, update func(status *Status)) error {
 	log.mu.Lock()
-	defer log.mu.Unlock()
-
 	entry, err := log.getEntryLocked(id)
 	if err != nil {
+		log.mu.Unlock()
 		return err
 	}
 
-	entry.status = status
+	finished := entry.status.Finished != nil
+	update(&entry.status)
+	entry.version++
+	version, status := entry.version, entry.status
+	log.mu.Unlock()
+
+	if log.store != nil {
+		log.saveStatus(id, entry, version, status)
+	}
+	// The final status is saved by the time anyone waiting for it is told.
+	if !finished && status.Finished != nil {
+		close(entry.done)
+	}
+
 	return nil
 }
 
-func (log *log) getStatus(id string) (string, error) {
+// saveStatus saves the given version of the status of an entry in the store,
+// unless a later one has been saved already. Failures are only logged.
+func (log *log) saveStatus(id string, entry *logEntry, version uint64, status Status) {
+	entry.saveMu.Lock()
+	defer entry.saveMu.Unlock()
+
+	if entry.removed || version <= entry.savedVersion {
+		return
+	}
+	entry.savedVersion = version
+
+	err := log.store.SaveStatus(id, status)
+	if err != nil {
+		stdlog.Printf("saving status of job %s: %v", id, err)
+	}
+}
+
+// getDone returns a channel that is closed once the final status of an entry has
+// been set.
+func (log *log) getDone(id string) (<-chan struct{}, error) {
 	log.mu.RLock()
 	defer log.mu.RUnlock()
 
 	entry, err := log.getEntryLocked(id)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return entry.done, nil
+}
+
+func (log *log) getStatus(id string) (Status, error) {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+
+	entry, err := log.getEntryLocked(id)
+	if err != nil {
+		return Status{}, err
 	}
 
 	return entry.status, nil
 }
 
-func (log *log) getOutputBuffer(id string) (*syncBuffer, error) {
+func (log *log) getOutput(id string) (*output, error) {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+
+	entry, err := log.getEntryLocked(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.output, nil
+}
+
+func (log *log) getOutputBuffer(id string, stream Stream) (*syncBuffer, error) {
+	output, err := log.getOutput(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return output.buffer(stream)
+}
+
+// setProcess records the started process of an entry. It returns false if the job
+// was killed while the process started (see cancelStart), in which case the process
+// is not recorded and must be killed.
+func (log *log) setProcess(id string, p *process) bool {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	entry, _ := log.getEntryLocked(id)
+	if entry.status.Done() {
+		return false
+	}
+
+	entry.process = p
+	return true
+}
+
+func (log *log) getProcess(id string) (*process, error) {
 	log.mu.RLock()
 	defer log.mu.RUnlock()
 
@@ -94,29 +274,77 @@ func (log *log) getOutputBuffer(id string) (*syncBuffer, error) {
 	if err != nil {
 		return nil, err
 	}
+	if entry.process == nil || entry.status.Done() {
+		return nil, &ErrJobNotActive{"job not active"}
+	}
+
+	return entry.process, nil
+}
+
+// cancelStart returns the process of an active entry. If the process has yet to
+// start, the entry is marked as killed instead, so that whoever starts the job
+// sees that it must not run, and a nil process is returned along with a channel
+// closed once the final status has been set.
+func (log *log) cancelStart(id string) (*process, <-chan struct{}, error) {
+	log.mu.Lock()
+	entry, err := log.getEntryLocked(id)
+	if err != nil {
+		log.mu.Unlock()
+		return nil, nil, err
+	}
+	if entry.status.Done() {
+		log.mu.Unlock()
+		return nil, nil, &ErrJobNotActive{"job not active"}
+	}
+	if entry.process != nil {
+		log.mu.Unlock()
+		return entry.process, nil, nil
+	}
+
+	entry.status.State = StateKilled
+	entry.version++
+	version, status := entry.version, entry.status
+	log.mu.Unlock()
+
+	if log.store != nil {
+		log.saveStatus(id, entry, version, status)
+	}
 
-	return entry.outputBuffer, nil
+	return nil, entry.done, nil
 }
 
-func (log *log) makeKillC(id string) chan bool {
+func (log *log) setStdin(id string, stdin *stdinPipe) {
 	log.mu.Lock()
 	defer log.mu.Unlock()
 
 	entry, _ := log.getEntryLocked(id)
-	entry.killC = make(chan bool)
+	entry.stdin = stdin
+}
+
+func (log *log) getStdin(id string) (*stdinPipe, error) {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
 
-	return entry.killC
+	entry, err := log.getEntryLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	if entry.stdin == nil {
+		return nil, &ErrStdinClosed{"job was not started with an open stdin"}
+	}
+
+	return entry.stdin, nil
 }
 
-func (log *log) nullifyKillC(id string) {
+func (log *log) setTerminal(id string, tty *terminal) {
 	log.mu.Lock()
 	defer log.mu.Unlock()
 
 	entry, _ := log.getEntryLocked(id)
-	entry.killC = nil
+	entry.tty = tty
 }
 
-func (log *log) getKillC(id string) (chan bool, error) {
+func (log *log) getTerminal(id string) (*terminal, error) {
 	log.mu.RLock()
 	defer log.mu.RUnlock()
 
@@ -124,9 +352,12 @@ func (log *log) getKillC(id string) (chan bool, error) {
 	if err != nil {
 		return nil, err
 	}
-	if entry.killC == nil {
+	if entry.tty == nil {
+		return nil, &ErrNoTerminal{"job was not started with a terminal"}
+	}
+	if entry.status.Done() {
 		return nil, &ErrJobNotActive{"job not active"}
 	}
 
-	return entry.killC, nil
+	return entry.tty, nil
 }
@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// cloneFlags returns the namespaces a process is cloned into for the given isolation.
+func cloneFlags(isolation *Isolation) uintptr {
+	flags := syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS
+	if !isolation.HostNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	return uintptr(flags)
+}
+
+// setupNamespaces prepares the namespaces of the calling init process: mounts are
+// made private so that they do not leak to the host, a fresh /proc is mounted to
+// reflect the new PID namespace, and the hostname and network are configured.
+func setupNamespaces(config initConfig) error {
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+
+	err = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NOEXEC|syscall.MS_NODEV, "")
+	if err != nil {
+		return fmt.Errorf("mounting /proc: %v", err)
+	}
+
+	err = syscall.Sethostname([]byte(config.Hostname))
+	if err != nil {
+		return fmt.Errorf("setting hostname: %v", err)
+	}
+
+	if config.Loopback {
+		err = setLinkUp("lo")
+		if err != nil {
+			return fmt.Errorf("bringing up loopback: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// ifreq mirrors the kernel's struct ifreq for the interface flag ioctls.
+type ifreq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// setLinkUp sets the IFF_UP flag on the network interface with the given name.
+func setLinkUp(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var req ifreq
+	copy(req.name[:], name)
+
+	err = ioctl(fd, syscall.SIOCGIFFLAGS, unsafe.Pointer(&req))
+	if err != nil {
+		return err
+	}
+
+	req.flags |= syscall.IFF_UP
+
+	return ioctl(fd, syscall.SIOCSIFFLAGS, unsafe.Pointer(&req))
+}
+
+func ioctl(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package worker
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A Stream selects which output of a process to read.
+type Stream string
+
+const (
+	// StreamCombined interleaves stdout and stderr in the order they were written.
+	StreamCombined Stream = "combined"
+	StreamStdout   Stream = "stdout"
+	StreamStderr   Stream = "stderr"
+)
+
+// ParseStream returns the Stream with the given name. An empty name selects
+// StreamCombined.
+func ParseStream(name string) (Stream, error) {
+	switch Stream(name) {
+	case "", StreamCombined:
+		return StreamCombined, nil
+	case StreamStdout, StreamStderr:
+		return Stream(name), nil
+	}
+
+	return "", fmt.Errorf("unknown stream %q", name)
+}
+
+// MaxReadLength is the most output that is read from a process at once, so that
+// reading a large output does not hold all of it in memory. The rest can be read
+// in further chunks.
+const MaxReadLength = 1 << 20
+
+// An OutputRange selects part of the output of a process. The zero value selects
+// all of it, up to MaxReadLength bytes.
+type OutputRange struct {
+	// Offset is the offset in bytes of the first byte to read.
+	Offset int64
+	// Length is the maximum number of bytes to read. It defaults to, and may not
+	// exceed, MaxReadLength.
+	Length int64
+	// Tail, if set, selects the last Tail lines instead of starting at Offset.
+	Tail int
+}
+
+// An OutputChunk is the part of the output of a process selected by an OutputRange.
+// Where output has been discarded, it contains a line saying how many bytes were
+// discarded instead.
+type OutputChunk struct {
+	Output string
+	// Offset is the offset of the start of Output.
+	Offset int64
+	// Next is the offset following Output, from which to continue reading.
+	Next int64
+	// Size is the number of bytes output so far.
+	Size int64
+}
+
+// An output captures stdout and stderr of a process separately, as well as
+// combined in the order they were written. Since the streams reach the worker
+// through separate pipes, writes made by the process in very quick succession
+// may appear in the combined stream in the order they were read instead.
+type output struct {
+	mu       sync.Mutex // Serializes writes so that combined preserves their order.
+	stdout   *syncBuffer
+	stderr   *syncBuffer
+	combined *syncBuffer
+}
+
+// newOutput creates an output whose streams each hold at most limit bytes in memory,
+// as described by newSyncBuffer.
+func newOutput(limit int64, pool *memoryPool, spillDir string) *output {
+	return &output{
+		stdout:   newSyncBuffer(limit, pool, spillDir),
+		stderr:   newSyncBuffer(limit, pool, spillDir),
+		combined: newSyncBuffer(limit, pool, spillDir),
+	}
+}
+
+// writer returns an io.Writer that captures the given stream.
+func (o *output) writer(stream Stream) *streamWriter {
+	w := &streamWriter{o: o, buf: o.stdout}
+	if stream == StreamStderr {
+		w.buf = o.stderr
+	}
+
+	return w
+}
+
+// buffer returns the buffer holding the given stream.
+func (o *output) buffer(stream Stream) (*syncBuffer, error) {
+	switch stream {
+	case "", StreamCombined:
+		return o.combined, nil
+	case StreamStdout:
+		return o.stdout, nil
+	case StreamStderr:
+		return o.stderr, nil
+	}
+
+	return nil, fmt.Errorf("unknown stream %q", stream)
+}
+
+// setBuffer sets the buffer holding the given stream.
+func (o *output) setBuffer(stream Stream, buf *syncBuffer) {
+	switch stream {
+	case StreamCombined:
+		o.combined = buf
+	case StreamStdout:
+		o.stdout = buf
+	case StreamStderr:
+		o.stderr = buf
+	}
+}
+
+// Close marks the end of all streams.
+func (o *output) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.stdout.Close()
+	o.stderr.Close()
+	o.combined.Close()
+
+	return nil
+}
+
+// release frees the memory and files held by all streams, whose output is lost.
+func (o *output) release() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.stdout.release()
+	o.stderr.release()
+	o.combined.release()
+}
+
+// A streamWriter writes to a single stream of an output.
+type streamWriter struct {
+	o   *output
+	buf *syncBuffer
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.o.mu.Lock()
+	defer w.o.mu.Unlock()
+
+	n, err := w.buf.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return w.o.combined.Write(p[:n])
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd start in a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends sig to every process in the process group led by pid.
+func signalGroup(pid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pid, sig)
+	if err == syscall.ESRCH {
+		// The group is already gone, but the process has yet to be reaped.
+		return nil
+	}
+
+	return err
+}
+
+// setCredential makes cmd run with the given credential.
+func setCredential(cmd *exec.Cmd, cred *credential) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    cred.Uid,
+		Gid:    cred.Gid,
+		Groups: cred.Groups,
+	}
+
+	return nil
+}
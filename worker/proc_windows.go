@@ -0,0 +1,31 @@
+package worker
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup does nothing, since Windows has no process groups.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalGroup terminates the process with the given pid. Windows only supports
+// SIGKILL, and cannot terminate the descendants of the process.
+func signalGroup(pid int, sig syscall.Signal) error {
+	if sig != syscall.SIGKILL {
+		return errors.New("only SIGKILL is supported on Windows")
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return p.Kill()
+}
+
+// setCredential fails, since processes cannot be started as another user on Windows.
+func setCredential(cmd *exec.Cmd, cred *credential) error {
+	return errors.New("users and groups are not supported on Windows")
+}
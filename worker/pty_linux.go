@@ -0,0 +1,135 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ttyDrainTimeout is how long a terminal waits, after its process has exited, for
+// remaining output to be copied. Output can be held up indefinitely by descendants
+// of the process that keep the terminal open.
+const ttyDrainTimeout = time.Second
+
+// A terminal is a pseudo-terminal pair. The process runs on the slave end, while
+// the worker reads output from and writes input to the master end.
+type terminal struct {
+	master *os.File
+	slave  *os.File
+	copied chan struct{} // Closed once output copying has ended.
+}
+
+// openTerminal allocates a new pseudo-terminal.
+func openTerminal() (*terminal, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var n uint32
+	err = controlFile(master, func(fd uintptr) error {
+		var unlock int32
+		err := ioctl(int(fd), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+		if err != nil {
+			return err
+		}
+		return ioctl(int(fd), syscall.TIOCGPTN, unsafe.Pointer(&n))
+	})
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	return &terminal{master: master, slave: slave, copied: make(chan struct{})}, nil
+}
+
+// setup makes cmd run on the terminal, as the leader of a new session with the
+// terminal as its controlling terminal. The session doubles as the process group
+// of the process.
+func (t *terminal) setup(cmd *exec.Cmd) {
+	cmd.Stdin = t.slave
+	cmd.Stdout = t.slave
+	cmd.Stderr = t.slave
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0 // The child's stdin.
+}
+
+// closeSlave closes the worker's copy of the slave end, once the process holds
+// its own.
+func (t *terminal) closeSlave() {
+	t.slave.Close()
+}
+
+// copyOutput starts copying everything written to the terminal to w.
+func (t *terminal) copyOutput(w io.Writer) {
+	go func() {
+		// Reading fails with EIO once every slave file has been closed.
+		io.Copy(w, t.master)
+		close(t.copied)
+	}()
+}
+
+// drain waits for output copying to end, for at most ttyDrainTimeout.
+func (t *terminal) drain() {
+	select {
+	case <-t.copied:
+	case <-time.After(ttyDrainTimeout):
+		t.master.Close()
+		<-t.copied
+	}
+}
+
+// Write sends input to the process as if it had been typed.
+func (t *terminal) Write(p []byte) (int, error) {
+	return t.master.Write(p)
+}
+
+// resize sets the window size of the terminal, which sends SIGWINCH to the
+// foreground process group.
+func (t *terminal) resize(rows, cols uint16) error {
+	ws := struct{ rows, cols, xpixel, ypixel uint16 }{rows, cols, 0, 0}
+
+	return controlFile(t.master, func(fd uintptr) error {
+		return ioctl(int(fd), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+	})
+}
+
+// Close releases the terminal.
+func (t *terminal) Close() error {
+	t.slave.Close()
+	return t.master.Close()
+}
+
+// controlFile calls f with the file descriptor of the given file. Unlike f.Fd, it
+// leaves the file in non-blocking mode, so that closing it interrupts reads.
+func controlFile(file *os.File, f func(fd uintptr) error) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	err = conn.Control(func(fd uintptr) {
+		ferr = f(fd)
+	})
+	if err != nil {
+		return err
+	}
+
+	return ferr
+}
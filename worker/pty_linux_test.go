@@ -0,0 +1,47 @@
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTerminal(t *testing.T) {
+	w := NewWorker()
+
+	id, err := w.Run(Job{Command: "sh", TTY: true})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		err = w.Resize(id, 42, 123)
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Error resizing terminal: %v", err)
+	}
+
+	_, err = w.WriteStdin(id, strings.NewReader("test -t 0 && stty size\nexit 7\n"))
+	if err != nil {
+		t.Fatalf("Error writing to terminal: %v", err)
+	}
+
+	status := waitForJob(t, w, id)
+	if status.ExitCode == nil || *status.ExitCode != 7 {
+		t.Errorf("got %s, want exit code 7", status)
+	}
+
+	out, _ := w.Out(id, StreamStdout)
+	if !strings.Contains(out, "42 123") {
+		t.Errorf("got output %q, want terminal size 42 123", out)
+	}
+
+	err = w.Resize(id, 24, 80)
+	if _, ok := err.(*ErrJobNotActive); !ok {
+		t.Errorf("got %v resizing after exit, want ErrJobNotActive", err)
+	}
+}
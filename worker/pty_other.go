@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+)
+
+// A terminal is a placeholder on platforms without pseudo-terminal support.
+type terminal struct{}
+
+func openTerminal() (*terminal, error) {
+	return nil, errors.New("terminals are only supported on Linux")
+}
+
+func (t *terminal) setup(cmd *exec.Cmd) {}
+
+func (t *terminal) closeSlave() {}
+
+func (t *terminal) copyOutput(w io.Writer) {}
+
+func (t *terminal) drain() {}
+
+func (t *terminal) Write(p []byte) (int, error) { return 0, errors.New("no terminal") }
+
+func (t *terminal) resize(rows, cols uint16) error { return errors.New("no terminal") }
+
+func (t *terminal) Close() error { return nil }
@@ -0,0 +1,291 @@
+package worker
+
+import (
+	"sync"
+)
+
+// WithConcurrency caps how many processes run at the same time, in total and for
+// each user (see Job.Owner). A limit of zero removes the corresponding cap. Jobs
+// over a cap wait in the queued state until enough running processes have ended.
+func WithConcurrency(total, perUser int) Option {
+	return func(w *Worker) {
+		w.queue.limit = total
+		w.queue.userLimit = perUser
+	}
+}
+
+// WithUserWeights sets the share of queued jobs started for each user relative to
+// the others, e.g. a user with weight 2 has twice as many jobs started as a user
+// with weight 1 while both have jobs waiting. Users default to a weight of 1.
+func WithUserWeights(weights map[string]int) Option {
+	return func(w *Worker) {
+		w.queue.weights = weights
+	}
+}
+
+// A QueuedJob describes a job waiting to start.
+type QueuedJob struct {
+	ID       string `json:"id"`
+	Owner    string `json:"owner,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	// Position is the 1-based position of the job in the order in which queued
+	// jobs are expected to start.
+	Position int `json:"position"`
+}
+
+// Queue returns the jobs waiting to start, in the order in which they are expected
+// to start if no other job is submitted.
+func (w *Worker) Queue() []QueuedJob {
+	return w.queue.list()
+}
+
+// A queue admits jobs to run within the concurrency limits of the worker.
+//
+// Waiting jobs are started fairly between users: each user is given turns in
+// proportion to their weight, as in weighted round-robin, and on their turn the
+// waiting job of that user with the highest priority starts, the oldest one first
+// among equals. Priorities therefore only order the jobs of a single user. A job
+// whose owner is at the per-user limit does not hold up the jobs of other users.
+type queue struct {
+	mu        sync.Mutex
+	limit     int
+	userLimit int
+	weights   map[string]int
+
+	running     int
+	userRunning map[string]int
+	waiting     []*queuedJob // In order of submission.
+	share       fairShare
+}
+
+// A queuedJob is a job waiting in a queue.
+type queuedJob struct {
+	id       string
+	owner    string
+	priority int
+	// start is called once the job is admitted.
+	start func()
+}
+
+// limited returns true if the queue may make jobs wait.
+func (q *queue) limited() bool {
+	return q.limit > 0 || q.userLimit > 0
+}
+
+// submit admits the job with the given id, owner and priority, calling start if it
+// may run immediately or otherwise once its turn comes.
+func (q *queue) submit(id, owner string, priority int, start func()) {
+	q.mu.Lock()
+	// Waiting jobs are only held up by the per-user limit while fewer jobs than the
+	// total limit run, so the job may only overtake those of other users.
+	admitted := !q.waitingLocked(owner) && q.admitLocked(owner)
+	if admitted {
+		q.share.charge(owner, q.weight(owner))
+	} else {
+		q.waiting = append(q.waiting, &queuedJob{id: id, owner: owner, priority: priority, start: start})
+	}
+	q.mu.Unlock()
+
+	if admitted {
+		start()
+	}
+}
+
+// admitLocked counts a new running job of the given owner, unless that would
+// exceed a limit. It returns true if the job was counted.
+func (q *queue) admitLocked(owner string) bool {
+	if q.limit > 0 && q.running >= q.limit {
+		return false
+	}
+	if q.userLimit > 0 && q.userRunning[owner] >= q.userLimit {
+		return false
+	}
+
+	if q.userRunning == nil {
+		q.userRunning = make(map[string]int)
+	}
+	q.running++
+	q.userRunning[owner]++
+
+	return true
+}
+
+// waitingLocked returns true if a job of the given owner is waiting.
+func (q *queue) waitingLocked(owner string) bool {
+	for _, job := range q.waiting {
+		if job.owner == owner {
+			return true
+		}
+	}
+
+	return false
+}
+
+// weight returns the weight of the given user.
+func (q *queue) weight(owner string) int {
+	if weight := q.weights[owner]; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// done records that a job of the given owner admitted by the queue has ended, and
+// starts the waiting jobs that may now run.
+func (q *queue) done(owner string) {
+	q.mu.Lock()
+	q.running--
+	q.userRunning[owner]--
+	if q.userRunning[owner] == 0 {
+		delete(q.userRunning, owner)
+	}
+
+	var admitted []*queuedJob
+	for q.limit == 0 || q.running < q.limit {
+		i := nextJob(q.waiting, q.share, func(owner string) bool {
+			return q.userLimit == 0 || q.userRunning[owner] < q.userLimit
+		})
+		if i < 0 {
+			break
+		}
+
+		job := q.waiting[i]
+		q.admitLocked(job.owner)
+		q.share.charge(job.owner, q.weight(job.owner))
+		q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+		admitted = append(admitted, job)
+	}
+	q.mu.Unlock()
+
+	for _, job := range admitted {
+		job.start()
+	}
+}
+
+// nextJob returns the index in waiting, which is in order of submission, of the
+// job to start next given the share of each user, or -1 if none may start. Only
+// the jobs of the users for which allowed returns true are considered.
+func nextJob(waiting []*queuedJob, share fairShare, allowed func(owner string) bool) int {
+	// The job each user would start next, and the user whose turn it is.
+	best := make(map[string]int)
+	turn := ""
+	for i, job := range waiting {
+		if !allowed(job.owner) {
+			continue
+		}
+
+		j, ok := best[job.owner]
+		if !ok {
+			best[job.owner] = i
+			// Users are seen in the order of their oldest waiting job, which breaks
+			// ties between equal shares.
+			if len(best) == 1 || share.pass(job.owner) < share.pass(turn) {
+				turn = job.owner
+			}
+			continue
+		}
+		if job.priority > waiting[j].priority {
+			best[job.owner] = i
+		}
+	}
+
+	if len(best) == 0 {
+		return -1
+	}
+	return best[turn]
+}
+
+// remove takes the job with the given id out of the queue. It returns false if the
+// job was not waiting.
+func (q *queue) remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, job := range q.waiting {
+		if job.id == id {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// list returns the waiting jobs in the order in which they are expected to start,
+// which is worked out by giving turns to the users as if a job started whenever the
+// per-user limit allows it.
+func (q *queue) list() []QueuedJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	waiting := append([]*queuedJob(nil), q.waiting...)
+	share := q.share.clone()
+	all := func(string) bool { return true }
+
+	jobs := make([]QueuedJob, 0, len(waiting))
+	for len(waiting) > 0 {
+		i := nextJob(waiting, share, all)
+		job := waiting[i]
+		share.charge(job.owner, q.weight(job.owner))
+		waiting = append(waiting[:i], waiting[i+1:]...)
+
+		jobs = append(jobs, QueuedJob{
+			ID:       job.id,
+			Owner:    job.owner,
+			Priority: job.priority,
+			Position: len(jobs) + 1,
+		})
+	}
+
+	return jobs
+}
+
+// positions returns the position of every waiting job, by id (see QueuedJob).
+func (q *queue) positions() map[string]int {
+	jobs := q.list()
+
+	positions := make(map[string]int, len(jobs))
+	for _, job := range jobs {
+		positions[job.ID] = job.Position
+	}
+
+	return positions
+}
+
+// A fairShare keeps track of whose turn it is to start a job, using stride
+// scheduling: each user has a pass value, which grows by the inverse of their
+// weight whenever one of their jobs starts, and the waiting user with the lowest
+// pass value goes next.
+type fairShare struct {
+	passes map[string]float64
+	// now is the pass value at which the last job started. Users who have not had
+	// jobs waiting are brought up to it, so they cannot save up turns.
+	now float64
+}
+
+// pass returns the pass value of the given user.
+func (f fairShare) pass(owner string) float64 {
+	if pass := f.passes[owner]; pass > f.now {
+		return pass
+	}
+	return f.now
+}
+
+// charge records that a job of the given user with the given weight has started.
+func (f *fairShare) charge(owner string, weight int) {
+	if f.passes == nil {
+		f.passes = make(map[string]float64)
+	}
+
+	f.now = f.pass(owner)
+	f.passes[owner] = f.now + 1/float64(weight)
+}
+
+// clone returns a copy of the share that can be charged independently.
+func (f fairShare) clone() fairShare {
+	passes := make(map[string]float64, len(f.passes))
+	for owner, pass := range f.passes {
+		passes[owner] = pass
+	}
+
+	return fairShare{passes: passes, now: f.now}
+}
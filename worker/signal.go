@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalName returns the conventional name of the given signal, e.g. "SIGTERM".
+func signalName(sig syscall.Signal) string {
+	name, ok := signalNames[sig]
+	if !ok {
+		return fmt.Sprintf("signal %d", int(sig))
+	}
+
+	return name
+}
+
+// ParseSignal returns the signal with the given name, which may be given with or
+// without the "SIG" prefix (e.g. "SIGTERM" or "term"), or as the number of a known
+// signal.
+func ParseSignal(name string) (syscall.Signal, error) {
+	n, err := strconv.Atoi(name)
+	if err == nil {
+		if _, ok := signalNames[syscall.Signal(n)]; !ok {
+			return 0, fmt.Errorf("unknown signal %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	for sig, sigName := range signalNames {
+		if sigName == name {
+			return sig, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import "syscall"
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT:  "SIGABRT",
+	syscall.SIGALRM:  "SIGALRM",
+	syscall.SIGBUS:   "SIGBUS",
+	syscall.SIGCHLD:  "SIGCHLD",
+	syscall.SIGCONT:  "SIGCONT",
+	syscall.SIGFPE:   "SIGFPE",
+	syscall.SIGHUP:   "SIGHUP",
+	syscall.SIGILL:   "SIGILL",
+	syscall.SIGINT:   "SIGINT",
+	syscall.SIGKILL:  "SIGKILL",
+	syscall.SIGPIPE:  "SIGPIPE",
+	syscall.SIGPROF:  "SIGPROF",
+	syscall.SIGQUIT:  "SIGQUIT",
+	syscall.SIGSEGV:  "SIGSEGV",
+	syscall.SIGSTOP:  "SIGSTOP",
+	syscall.SIGSYS:   "SIGSYS",
+	syscall.SIGTERM:  "SIGTERM",
+	syscall.SIGTRAP:  "SIGTRAP",
+	syscall.SIGTSTP:  "SIGTSTP",
+	syscall.SIGTTIN:  "SIGTTIN",
+	syscall.SIGTTOU:  "SIGTTOU",
+	syscall.SIGURG:   "SIGURG",
+	syscall.SIGUSR1:  "SIGUSR1",
+	syscall.SIGUSR2:  "SIGUSR2",
+	syscall.SIGWINCH: "SIGWINCH",
+	syscall.SIGXCPU:  "SIGXCPU",
+	syscall.SIGXFSZ:  "SIGXFSZ",
+}
+
+// pauseSignals stop a process until it is sent resumeSignal.
+var pauseSignals = map[syscall.Signal]bool{
+	syscall.SIGSTOP: true,
+	syscall.SIGTSTP: true,
+	syscall.SIGTTIN: true,
+	syscall.SIGTTOU: true,
+}
+
+const resumeSignal = syscall.SIGCONT
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+)
+
+// A State is a stage in the lifecycle of a process.
+type State string
+
+const (
+	// StateQueued is used while a process waits for the concurrency limits of the
+	// worker to allow it to start.
+	StateQueued State = "queued"
+	StateActive State = "active"
+	// StatePaused is used while a process has been stopped by a signal such as
+	// SIGSTOP, until it is resumed with SIGCONT.
+	StatePaused   State = "paused"
+	StateComplete State = "complete"
+	StateError    State = "error"
+	StateKilled   State = "killed"
+	// StateTimedOut is used when a process is terminated for running past its
+	// timeout or deadline.
+	StateTimedOut State = "timed-out"
+	// StateOOMKilled is used when the kernel OOM killer terminates a process for
+	// exceeding its memory limit.
+	StateOOMKilled State = "oom-killed"
+	// StateLost is used when a process was still running when the worker stopped,
+	// so how it ended is unknown.
+	StateLost State = "lost"
+)
+
+// Status describes the state of a process and how it ended.
+type Status struct {
+	State State `json:"state"`
+
+	// ExitCode is set if the process exited by itself, rather than by a signal.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Signal is the name of the signal that terminated the process, if any.
+	Signal string `json:"signal,omitempty"`
+	// Error explains why the process could not be started, or why its outcome
+	// is unknown.
+	Error string `json:"error,omitempty"`
+
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Deadline is the time at which the process is terminated if still running.
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	// OutputSize is the number of bytes output so far, stdout and stderr combined.
+	OutputSize int64 `json:"output_size,omitempty"`
+	// QueuePosition is the 1-based position of a queued process in the queue.
+	QueuePosition int `json:"queue_position,omitempty"`
+}
+
+// Done returns true if the process has ended.
+func (s Status) Done() bool {
+	return s.State != StateQueued && s.State != StateActive && s.State != StatePaused
+}
+
+// String summarizes the status in a human readable form, e.g.
+// "error (exit code 2)".
+func (s Status) String() string {
+	switch {
+	case len(s.Error) > 0:
+		return fmt.Sprintf("%s - %s", s.State, s.Error)
+	case s.ExitCode != nil:
+		return fmt.Sprintf("%s (exit code %d)", s.State, *s.ExitCode)
+	case len(s.Signal) > 0:
+		return fmt.Sprintf("%s (%s)", s.State, s.Signal)
+	case s.QueuePosition > 0:
+		return fmt.Sprintf("%s (position %d)", s.State, s.QueuePosition)
+	}
+
+	return string(s.State)
+}
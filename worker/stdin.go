@@ -0,0 +1,106 @@
+package worker
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrStdinClosed occurs when writing to the stdin of a process that was not started
+// with an open stdin, or whose stdin has been closed.
+type ErrStdinClosed struct{ msg string }
+
+func (e *ErrStdinClosed) Error() string { return e.msg }
+
+// A stdinPipe is the writing end of the stdin of a process started with an open
+// stdin or a terminal. Writes are serialized, so that concurrent writers do not
+// interleave, but closing the pipe does not wait for a writer, which may be idle.
+type stdinPipe struct {
+	writeMu sync.Mutex // Held by the current writer.
+
+	mu     sync.Mutex // Guards closed.
+	w      io.WriteCloser
+	closed bool
+}
+
+// newStdinPipe returns a stdinPipe and the reading end to hand to the process.
+func newStdinPipe() (*stdinPipe, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &stdinPipe{w: w}, r, nil
+}
+
+// newTerminalStdin returns a stdinPipe writing to the given terminal.
+func newTerminalStdin(t *terminal) *stdinPipe {
+	return &stdinPipe{w: terminalInput{t}}
+}
+
+// terminalInput is the input of a terminal. Since the terminal remains open as
+// long as the process runs, closing it sends an end-of-transmission character
+// (Ctrl-D) instead, which a process reading lines from the terminal reads as EOF.
+type terminalInput struct {
+	t *terminal
+}
+
+func (in terminalInput) Write(p []byte) (int, error) { return in.t.Write(p) }
+
+func (in terminalInput) Close() error {
+	_, err := in.t.Write([]byte{0x04})
+	return err
+}
+
+// copyFrom writes everything read from r to the pipe, until it is closed.
+func (p *stdinPipe) copyFrom(r io.Reader) (int64, error) {
+	if p.isClosed() {
+		return 0, &ErrStdinClosed{"stdin closed"}
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	return io.Copy(stdinWriter{p}, r)
+}
+
+func (p *stdinPipe) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
+
+// stdinWriter writes to a stdinPipe as long as it is open. A write blocked on a
+// full pipe is released when it is closed.
+type stdinWriter struct {
+	p *stdinPipe
+}
+
+func (w stdinWriter) Write(b []byte) (int, error) {
+	if w.p.isClosed() {
+		return 0, &ErrStdinClosed{"stdin closed"}
+	}
+
+	n, err := w.p.w.Write(b)
+	if err != nil && w.p.isClosed() {
+		err = &ErrStdinClosed{"stdin closed"}
+	}
+
+	return n, err
+}
+
+// Close closes the pipe, so that the process reads EOF once it has consumed
+// everything written before.
+func (p *stdinPipe) Close() error {
+	p.mu.Lock()
+	closed := p.closed
+	p.closed = true
+	p.mu.Unlock()
+
+	if closed {
+		return &ErrStdinClosed{"stdin closed"}
+	}
+
+	return p.w.Close()
+}
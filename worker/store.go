@@ -0,0 +1,147 @@
+package worker
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// A Store persists jobs, so that a Worker can restore them after a restart (see
+// WithStore and Worker.Restore).
+type Store interface {
+	// SaveJob adds a new job to the store.
+	SaveJob(info JobInfo) error
+	// SaveStatus records a new status for the job with the given id.
+	SaveStatus(id string, status Status) error
+	// LoadJobs returns every job in the store, with the last status recorded.
+	LoadJobs() ([]JobInfo, error)
+
+	// CreateOutput creates the file holding the given output stream of a new job.
+	CreateOutput(id string, stream Stream) (OutputFile, error)
+	// OpenOutput opens the file holding the given output stream of a saved job.
+	OpenOutput(id string, stream Stream) (OutputFile, error)
+
+	// Delete removes the job with the given id and its output from the store.
+	Delete(id string) error
+}
+
+// An OutputFile holds an output stream of a job saved in a Store. *os.File
+// implements it.
+type OutputFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+const (
+	// lostError explains the status of jobs that were running when the worker
+	// stopped.
+	lostError = "worker stopped while the job was running"
+	// lostQueuedError explains the status of jobs that were queued when the worker
+	// stopped.
+	lostQueuedError = "worker stopped before the job started"
+)
+
+// WithStore makes the worker save every job it runs, along with its output, in the
+// given store. Jobs saved by a previous worker are restored by Worker.Restore.
+func WithStore(store Store) Option {
+	return func(w *Worker) {
+		w.store = store
+	}
+}
+
+// Restore loads the jobs saved in the worker's store by previous workers. Jobs that
+// were still queued or running when their worker stopped are marked as lost, and the
+// processes of any job that had not finished that are still running in its cgroup
+// are killed.
+func (w *Worker) Restore() error {
+	if w.store == nil {
+		return nil
+	}
+
+	jobs, err := w.store.LoadJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range jobs {
+		if !info.Status.Done() {
+			info.Status.Error = lostError
+			if info.Status.State == StateQueued {
+				info.Status.Error = lostQueuedError
+			}
+			info.Status.State = StateLost
+		}
+		if info.Status.Finished == nil {
+			// Jobs that were lost, or were killed but not reaped yet, are dated from
+			// now, since when they stopped running is unknown.
+			now := time.Now()
+			info.Status.Finished = &now
+			err = w.store.SaveStatus(info.ID, info.Status)
+			if err != nil {
+				return err
+			}
+
+			if len(w.cgroupParent) > 0 {
+				removeCgroup(w.cgroupParent, info.ID)
+			}
+		}
+
+		w.log.restoreEntry(info, w.restoreOutput(info.ID))
+	}
+
+	return nil
+}
+
+// newOutput creates the output of a new job, saved in the worker's store if any.
+func (w *Worker) newOutput(id string) (*output, error) {
+	if w.store == nil {
+		return newOutput(w.outputLimit, w.outputPool, w.outputSpillDir), nil
+	}
+
+	o := &output{}
+	for _, stream := range []Stream{StreamStdout, StreamStderr, StreamCombined} {
+		f, err := w.store.CreateOutput(id, stream)
+		if err != nil {
+			for _, buf := range []*syncBuffer{o.stdout, o.stderr, o.combined} {
+				if buf != nil {
+					buf.Close()
+				}
+			}
+			return nil, err
+		}
+		o.setBuffer(stream, newStoredBuffer(w.outputLimit, w.outputPool, f, w.opener(id, stream)))
+	}
+
+	return o, nil
+}
+
+// restoreOutput creates the output of a job saved in the worker's store. Streams
+// that cannot be opened are restored as empty.
+func (w *Worker) restoreOutput(id string) *output {
+	o := &output{}
+	for _, stream := range []Stream{StreamStdout, StreamStderr, StreamCombined} {
+		var size int64
+
+		f, err := w.store.OpenOutput(id, stream)
+		if err == nil {
+			info, err := f.Stat()
+			if err == nil {
+				size = info.Size()
+			}
+			f.Close()
+		}
+
+		o.setBuffer(stream, restoredBuffer(size, w.opener(id, stream)))
+	}
+
+	return o
+}
+
+// opener returns a function opening the given output stream of a saved job.
+func (w *Worker) opener(id string, stream Stream) func() (OutputFile, error) {
+	return func() (OutputFile, error) {
+		return w.store.OpenOutput(id, stream)
+	}
+}
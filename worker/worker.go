@@ -1,140 +1,645 @@
 package worker
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/lithammer/shortuuid"
 )
 
-const (
-	statusActive   = "active"
-	statusComplete = "complete"
-	statusError    = "error"
-	statusKilled   = "killed"
-)
-
 // A JobWorker implements methods to run/terminate Linux processes and
 // query their output/status.
 type JobWorker interface {
-	Run(job Job) string
-	Status(id string) (string, error)
-	Out(id string) (string, error)
-	Kill(id string) error
+	Run(job Job) (string, error)
+	Status(id string) (Status, error)
+	Out(id string, stream Stream) (string, error)
+	ReadOutput(id string, stream Stream, r OutputRange) (OutputChunk, error)
+	Follow(ctx context.Context, id string, stream Stream, w io.Writer) error
+	Kill(id string, opts KillOptions) error
+	Signal(id string, sig syscall.Signal) error
+	WriteStdin(id string, r io.Reader) (int64, error)
+	CloseStdin(id string) error
+	Resize(id string, rows, cols uint16) error
+	Remove(id string) error
+	List(opts ListOptions) (JobList, error)
+	Queue() []QueuedJob
+	Wait(ctx context.Context, id string) (Status, error)
 }
 
 // Worker provides the machinery for executing and controlling Linux processes.
 // A zero value of this type is invalid - use NewWorker to create a new instance.
 type Worker struct {
-	log *log
-	mu  sync.Mutex // Used to synchronize the termination of processes.
+	log        *log
+	killGrace  time.Duration
+	maxTimeout time.Duration
+
+	outputLimit    int64
+	outputPool     *memoryPool
+	outputSpillDir string
+
+	store Store
+	queue queue
+
+	cgroupParent      string
+	cgroupLimitedOnly bool
+	cgroupOnce        sync.Once
+	cgroupErr         error
+}
+
+// An Option configures a Worker created by NewWorker.
+type Option func(*Worker)
+
+// WithCgroupParent makes the worker place every process in a dedicated cgroup v2
+// created beneath the given parent cgroup, e.g. "/sys/fs/cgroup/worker". This is
+// required for jobs with resource limits. The parent is created if necessary.
+func WithCgroupParent(path string) Option {
+	return func(w *Worker) {
+		w.cgroupParent = path
+		w.cgroupLimitedOnly = false
+	}
+}
+
+// WithLimitsCgroupParent is like WithCgroupParent, but only places the processes
+// of jobs with resource limits in a cgroup, so that other jobs still run on hosts
+// where cgroups are unavailable.
+func WithLimitsCgroupParent(path string) Option {
+	return func(w *Worker) {
+		w.cgroupParent = path
+		w.cgroupLimitedOnly = true
+	}
+}
+
+// WithKillGrace sets the default time a process is given to exit after being asked
+// to terminate by Kill, before it is forcefully killed.
+func WithKillGrace(grace time.Duration) Option {
+	return func(w *Worker) {
+		w.killGrace = grace
+	}
+}
+
+// WithMaxTimeout caps how long any process may run. Jobs that do not set a timeout
+// or deadline are given this timeout, and jobs asking for more are rejected.
+func WithMaxTimeout(timeout time.Duration) Option {
+	return func(w *Worker) {
+		w.maxTimeout = timeout
+	}
+}
+
+// WithOutputMemory caps the output held in memory for each stream of a process
+// (stdout, stderr and both combined), as well as in total across all processes. A
+// limit of zero removes the corresponding cap. Once a cap is reached, the oldest
+// output of the stream being written is discarded, unless WithOutputSpill is used.
+// Reading discarded output yields a line saying how many bytes were discarded.
+func WithOutputMemory(perStream, total int64) Option {
+	return func(w *Worker) {
+		w.outputLimit = perStream
+		w.outputPool.limit = total
+	}
+}
+
+// WithOutputSpill makes the worker move output that does not fit in memory to files
+// created in the given directory instead of discarding it. Spilled output is read
+// back transparently.
+func WithOutputSpill(dir string) Option {
+	return func(w *Worker) {
+		w.outputSpillDir = dir
+	}
 }
 
+const (
+	// DefaultKillGrace is the default grace period of Kill.
+	DefaultKillGrace = 10 * time.Second
+	// DefaultOutputMemory is the default cap on the output held in memory for each
+	// stream of a process.
+	DefaultOutputMemory = 1 << 20
+	// DefaultTotalOutputMemory is the default cap on the output held in memory
+	// across all processes.
+	DefaultTotalOutputMemory = 256 << 20
+)
+
 // NewWorker creates a new instance of the process worker.
-func NewWorker() *Worker {
-	return &Worker{
-		log: newLog(),
+func NewWorker(opts ...Option) *Worker {
+	w := &Worker{
+		log:         newLog(),
+		killGrace:   DefaultKillGrace,
+		outputLimit: DefaultOutputMemory,
+		outputPool:  &memoryPool{limit: DefaultTotalOutputMemory},
+	}
+	for _, opt := range opts {
+		opt(w)
 	}
+	w.log.store = w.store
+
+	return w
 }
 
 // Job represents a Linux process to be handled by the worker library.
 type Job struct {
 	Command string   `json:"command"`
 	Args    []string `json:"args"`
+	Limits  Limits   `json:"limits"`
+
+	// Labels are arbitrary key-value pairs attached to the job, by which jobs can
+	// be listed.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Owner identifies the user the job runs on behalf of, for per-user limits
+	// and fair sharing (see WithConcurrency). It is set by the server rather than
+	// by clients.
+	Owner string `json:"-"`
+	// Priority orders the queued jobs of the same owner: jobs with a higher
+	// priority start first. The default is 0, and negative priorities are allowed.
+	Priority int `json:"priority,omitempty"`
+
+	// Isolation, if set, runs the process in its own namespaces.
+	Isolation *Isolation `json:"isolation,omitempty"`
+
+	// Timeout, if set, limits how long the process may run once started. It is
+	// expressed in nanoseconds in JSON.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Deadline, if set, is the time at which the process is terminated if still
+	// running. If both Timeout and Deadline are set, the earliest applies.
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	// Env holds additional environment variables in "KEY=value" form. They are
+	// added to the worker's own environment, unless CleanEnv is set.
+	Env      []string `json:"env,omitempty"`
+	CleanEnv bool     `json:"clean_env,omitempty"`
+	// Dir is the working directory of the process. It defaults to the worker's.
+	// A relative Command is resolved against it, and a bare one against the PATH
+	// of the process's environment.
+	Dir string `json:"dir,omitempty"`
+	// User and Group set the identity of the process, by name or numeric id. They
+	// default to the worker's.
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// Stdin, if set, is fed to the process as its standard input.
+	Stdin []byte `json:"stdin,omitempty"`
+	// OpenStdin keeps the standard input of the process open, so that it can be
+	// written to with WriteStdin until it is closed with CloseStdin.
+	OpenStdin bool `json:"open_stdin,omitempty"`
+	// TTY runs the process on a pseudo-terminal. Its input is written with
+	// WriteStdin, and its output, in which stdout and stderr are indistinguishable,
+	// is captured as stdout.
+	TTY bool `json:"tty,omitempty"`
 }
 
+// Isolation runs a process in new PID, mount, UTS and network namespaces, so that it
+// only sees its own process tree (through a private /proc), has its own hostname and
+// has no network access beyond the loopback interface.
+type Isolation struct {
+	// HostNetwork shares the host's network namespace with the process instead of
+	// restricting it to loopback.
+	HostNetwork bool `json:"host_network,omitempty"`
+}
+
+// ErrInvalidJob occurs when a job cannot be run as specified.
+type ErrInvalidJob struct{ msg string }
+
+func (e *ErrInvalidJob) Error() string { return e.msg }
+
 // ErrJobNotFound occurs when a process cannot be found in the worker log.
 type ErrJobNotFound struct{ msg string }
 
 func (e *ErrJobNotFound) Error() string { return e.msg }
 
+// ErrNoTerminal occurs when a terminal operation is attempted on a process that was
+// not started with a terminal.
+type ErrNoTerminal struct{ msg string }
+
+func (e *ErrNoTerminal) Error() string { return e.msg }
+
+// ErrInvalidRange occurs when part of the output of a process is requested with an
+// invalid range.
+type ErrInvalidRange struct{ msg string }
+
+func (e *ErrInvalidRange) Error() string { return e.msg }
+
 // ErrJobNotActive occurs when termination is attempted on a process that
 // is no longer active.
 type ErrJobNotActive struct{ msg string }
 
 func (e *ErrJobNotActive) Error() string { return e.msg }
 
+// ErrJobActive occurs when an operation that requires a process to have ended is
+// attempted on a process that is still active.
+type ErrJobActive struct{ msg string }
+
+func (e *ErrJobActive) Error() string { return e.msg }
+
 // Run initiates the execution of a Linux process.
-func (w *Worker) Run(job Job) string {
+func (w *Worker) Run(job Job) (string, error) {
+	err := job.Limits.validate()
+	if err != nil {
+		return "", err
+	}
+	if !job.Limits.isZero() && len(w.cgroupParent) == 0 {
+		return "", &ErrInvalidJob{"resource limits are not enabled on this worker"}
+	}
+	err = w.validateTimeout(job)
+	if err != nil {
+		return "", err
+	}
+	for _, env := range job.Env {
+		if !strings.Contains(env, "=") {
+			return "", &ErrInvalidJob{fmt.Sprintf("environment variable %q is not in KEY=value form", env)}
+		}
+	}
+	for key := range job.Labels {
+		if len(key) == 0 || strings.Contains(key, "=") {
+			return "", &ErrInvalidJob{fmt.Sprintf("label key %q must be non-empty and not contain '='", key)}
+		}
+	}
+	if len(job.Stdin) > 0 && (job.OpenStdin || job.TTY) {
+		return "", &ErrInvalidJob{"a job cannot have both a stdin payload and an open stdin or terminal"}
+	}
+	cred, err := lookupCredential(job.User, job.Group)
+	if err != nil {
+		return "", err
+	}
+
 	id := shortuuid.New()
 
-	w.log.addEntry(id)
-	go w.execJob(id, job)
+	output, err := w.newOutput(id)
+	if err != nil {
+		return "", err
+	}
+	state := StateActive
+	if w.queue.limited() {
+		state = StateQueued
+	}
+	err = w.log.addEntry(id, job, state, output)
+	if err != nil {
+		output.Close()
+		return "", err
+	}
+
+	w.queue.submit(id, job.Owner, job.Priority, func() {
+		killed := false
+		w.log.updateStatus(id, func(status *Status) {
+			if status.State == StateQueued {
+				status.State = StateActive
+			}
+			killed = status.Done()
+		})
+		if killed {
+			// The job was killed as it was admitted, so it gives up its place.
+			w.cancel(id)
+			w.queue.done(job.Owner)
+			return
+		}
+		go w.runJob(id, job, cred)
+	})
+
+	return id, nil
+}
+
+// runJob runs a job admitted by the queue, and lets the queue know once it has
+// ended.
+func (w *Worker) runJob(id string, job Job, cred *credential) {
+	defer w.queue.done(job.Owner)
 
-	return id
+	w.execJob(id, job, cred)
 }
 
-func (w *Worker) execJob(id string, job Job) {
-	cmdctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+func (w *Worker) execJob(id string, job Job, cred *credential) {
+	output, err := w.log.getOutput(id)
+	if err != nil {
+		w.fail(id, err)
+		return
+	}
+	// Closing the output ends any Follow calls, so it is deferred until after the
+	// final status has been set.
+	defer output.Close()
+
+	var env []string
+	if job.CleanEnv {
+		env = append([]string{}, job.Env...)
+	} else if len(job.Env) > 0 {
+		env = append(os.Environ(), job.Env...)
+	}
 
-	cmd := exec.CommandContext(cmdctx, job.Command, job.Args...)
+	path, err := lookPath(job.Command, job.Dir, env)
+	if err != nil {
+		w.fail(id, err)
+		return
+	}
 
-	buf, err := w.log.getOutputBuffer(id)
+	cg, err := w.newJobCgroup(id, job.Limits)
 	if err != nil {
-		w.log.setStatus(id, fmt.Sprintf("%s - %s", statusError, err))
+		w.fail(id, err)
+		return
+	}
+	if cg != nil {
+		defer cg.remove()
+	}
+
+	cmd := exec.Command(path, job.Args...)
+	cmd.Dir = job.Dir
+	cmd.Env = env
+
+	var tty *terminal
+	if job.TTY {
+		tty, err = openTerminal()
+		if err != nil {
+			w.fail(id, err)
+			return
+		}
+		defer tty.Close()
+
+		tty.setup(cmd)
+		w.log.setTerminal(id, tty)
+		w.log.setStdin(id, newTerminalStdin(tty))
+	} else {
+		// Run the process in its own process group, so that its descendants can be
+		// terminated along with it.
+		setProcessGroup(cmd)
+		cmd.Stdout = output.writer(StreamStdout)
+		cmd.Stderr = output.writer(StreamStderr)
 	}
 
-	cmd.Stdout = buf
+	if len(job.Stdin) > 0 {
+		cmd.Stdin = bytes.NewReader(job.Stdin)
+	} else if job.OpenStdin && tty == nil {
+		stdin, r, err := newStdinPipe()
+		if err != nil {
+			w.fail(id, err)
+			return
+		}
+		defer stdin.Close()
 
-	// Direct cmd.Stderr to cmd.Stdout to interleave them as expected by command order.
-	cmd.Stderr = cmd.Stdout
+		cmd.Stdin = r
+		w.log.setStdin(id, stdin)
+	}
 
-	err = cmd.Start()
+	exitStatus, err := startCommand(cmd, id, job, cg, cred)
+	if tty != nil {
+		tty.closeSlave()
+	} else if f, ok := cmd.Stdin.(*os.File); ok {
+		// The process holds its own copy of the reading end once started, and
+		// writes must fail once it exits.
+		f.Close()
+	}
 	if err != nil {
-		w.log.setStatus(id, fmt.Sprintf("%s - %s", statusError, err))
+		w.fail(id, err)
 		return
 	}
+	if tty != nil {
+		tty.copyOutput(output.writer(StreamStdout))
+	}
+
+	p := &process{pid: cmd.Process.Pid, done: make(chan struct{})}
+	if !w.log.setProcess(id, p) {
+		// The job was killed while the process started. Its state is kept when the
+		// process is reaped.
+		signalGroup(p.pid, syscall.SIGKILL)
+	}
 
-	go w.listenForKill(cmdctx, cancel, id)
+	started := time.Now()
+	deadline := w.deadline(job, started)
+	w.log.updateStatus(id, func(status *Status) {
+		status.Started = &started
+		status.Deadline = deadline
+	})
+
+	if deadline != nil {
+		timer := time.AfterFunc(time.Until(*deadline), func() {
+			w.terminate(id, KillOptions{}, StateTimedOut)
+		})
+		defer timer.Stop()
+	}
 
 	err = cmd.Wait()
-	if err != nil {
-		// Prefer to keep 'kill' status if the process was terminated.
-		status, _ := w.log.getStatus(id)
-		if status != statusKilled {
-			w.log.setStatus(id, fmt.Sprintf("%s - %s", statusError, err))
+	if tty != nil {
+		tty.drain()
+	}
+	w.finish(id, exitStatus(), err, cg)
+	close(p.done)
+}
+
+// fail records that the process represented by the given id could not be started,
+// unless it was killed in the meantime.
+func (w *Worker) fail(id string, err error) {
+	w.log.updateStatus(id, func(status *Status) {
+		now := time.Now()
+		status.Finished = &now
+		if !status.Done() {
+			status.State = StateError
+			status.Error = err.Error()
+		}
+	})
+}
+
+// finish records the outcome of a process, given how it ended (if known) and the
+// error returned by waiting for it.
+func (w *Worker) finish(id string, ws *syscall.WaitStatus, waitErr error, cg *cgroup) {
+	w.log.updateStatus(id, func(status *Status) {
+		now := time.Now()
+		status.Finished = &now
+
+		if ws != nil {
+			if ws.Exited() {
+				code := ws.ExitStatus()
+				status.ExitCode = &code
+			}
+			if ws.Signaled() {
+				status.Signal = signalName(ws.Signal())
+			}
+		}
+
+		var exitErr *exec.ExitError
+		if waitErr != nil && !errors.As(waitErr, &exitErr) {
+			// The process ended, but its output could not be fully captured.
+			status.Error = waitErr.Error()
+		}
+
+		switch {
+		case status.State == StateKilled || status.State == StateTimedOut:
+			// Prefer to keep the state set when the process was terminated.
+		case cg != nil && cg.oomKilled():
+			status.State = StateOOMKilled
+		case waitErr != nil:
+			status.State = StateError
+		default:
+			status.State = StateComplete
+		}
+	})
+}
+
+// lookPath resolves command to an absolute path as the process will see it: relative
+// to the working directory dir (or the worker's, if empty), and searching the PATH
+// in env (or the worker's, if env is nil) if the command is a bare name.
+func lookPath(command, dir string, env []string) (string, error) {
+	if strings.Contains(command, "/") || strings.ContainsRune(command, filepath.Separator) {
+		path, err := absPath(dir, command)
+		if err != nil {
+			return "", err
+		}
+		return exec.LookPath(path)
+	}
+
+	pathList := os.Getenv("PATH")
+	if env != nil {
+		pathList = ""
+		for _, keyValue := range env {
+			// As in exec.Cmd, the last value of a duplicate variable takes precedence.
+			if strings.HasPrefix(keyValue, "PATH=") {
+				pathList = strings.TrimPrefix(keyValue, "PATH=")
+			}
+		}
+	}
+
+	for _, entry := range filepath.SplitList(pathList) {
+		// An empty entry stands for the working directory.
+		entryDir, err := absPath(dir, entry)
+		if err != nil {
+			return "", err
+		}
+		path, err := exec.LookPath(filepath.Join(entryDir, command))
+		if err == nil {
+			return path, nil
 		}
-		return
 	}
 
-	w.log.setStatus(id, statusComplete)
+	return "", &exec.Error{Name: command, Err: exec.ErrNotFound}
 }
 
-// listenForKill handles the termination of a running process when specified by
-// a call to Kill.
-func (w *Worker) listenForKill(ctx context.Context, cancel context.CancelFunc, id string) {
-	killC := w.log.makeKillC(id)
+// absPath returns path as an absolute path, resolving it relative to dir (or the
+// worker's working directory, if empty).
+func absPath(dir, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
 
-	select {
-	case <-killC:
-		cancel()
-		w.log.setStatus(id, statusKilled)
-		w.log.nullifyKillC(id)
-		killC <- true // Reply on the channel to signify that the process has been killed.
-	case <-ctx.Done():
-		// Process execution completed.
-		w.log.nullifyKillC(id)
+	return filepath.Abs(filepath.Join(dir, path))
+}
+
+// waitStatus returns how the process started by cmd ended, once it has been
+// waited for.
+func waitStatus(cmd *exec.Cmd) *syscall.WaitStatus {
+	if cmd.ProcessState == nil {
+		return nil
+	}
+	ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return nil
+	}
+
+	return &ws
+}
+
+// validateTimeout checks the timeout and deadline of a job against each other and
+// against the maximum timeout of the worker.
+func (w *Worker) validateTimeout(job Job) error {
+	if job.Timeout < 0 {
+		return &ErrInvalidJob{"timeout must not be negative"}
+	}
+	if job.Deadline != nil && !job.Deadline.After(time.Now()) {
+		return &ErrInvalidJob{"deadline has already passed"}
+	}
+
+	if w.maxTimeout > 0 {
+		tooLong := &ErrInvalidJob{fmt.Sprintf("jobs may not run for longer than %s", w.maxTimeout)}
+		if job.Timeout > w.maxTimeout {
+			return tooLong
+		}
+		if job.Timeout == 0 && job.Deadline != nil && time.Until(*job.Deadline) > w.maxTimeout {
+			return tooLong
+		}
+	}
+
+	return nil
+}
+
+// deadline returns the time at which a job started at the given time must be
+// terminated, or nil if it may run indefinitely.
+func (w *Worker) deadline(job Job, started time.Time) *time.Time {
+	var deadline *time.Time
+	earliest := func(t time.Time) {
+		if deadline == nil || t.Before(*deadline) {
+			deadline = &t
+		}
 	}
+
+	if job.Deadline != nil {
+		earliest(*job.Deadline)
+	}
+	if job.Timeout > 0 {
+		earliest(started.Add(job.Timeout))
+	}
+	if w.maxTimeout > 0 {
+		earliest(started.Add(w.maxTimeout))
+	}
+
+	return deadline
+}
+
+// newJobCgroup creates the cgroup for the job with the given id. It returns a nil
+// cgroup if the worker has not been configured to use cgroups, or only uses them
+// for jobs with resource limits and the job has none.
+func (w *Worker) newJobCgroup(id string, limits Limits) (*cgroup, error) {
+	if len(w.cgroupParent) == 0 || (w.cgroupLimitedOnly && limits.isZero()) {
+		return nil, nil
+	}
+
+	w.cgroupOnce.Do(func() {
+		w.cgroupErr = setupCgroupParent(w.cgroupParent)
+	})
+	if w.cgroupErr != nil {
+		return nil, w.cgroupErr
+	}
+
+	return newCgroup(w.cgroupParent, id, limits)
 }
 
 // Status returns the status of the process represented by the given id.
-func (w *Worker) Status(id string) (string, error) {
+func (w *Worker) Status(id string) (Status, error) {
 	status, err := w.log.getStatus(id)
 	if err != nil {
-		return "", err
+		return Status{}, err
+	}
+	buf, err := w.log.getOutputBuffer(id, StreamCombined)
+	if err != nil {
+		return Status{}, err
+	}
+	status.OutputSize = buf.len()
+	if status.State == StateQueued {
+		status.QueuePosition = w.queue.positions()[id]
 	}
 
 	return status, nil
 }
 
-// Out returns the output of the process represented by the given id.
-func (w *Worker) Out(id string) (string, error) {
-	buf, err := w.log.getOutputBuffer(id)
+// Remove deletes the process represented by the given id, which must have ended,
+// along with its output.
+func (w *Worker) Remove(id string) error {
+	entry, err := w.log.removeEntry(id)
+	if err != nil {
+		return err
+	}
+
+	entry.output.release()
+	if w.store != nil {
+		entry.stopSaving()
+		return w.store.Delete(id)
+	}
+
+	return nil
+}
+
+// Out returns the given output stream of the process represented by the given id.
+func (w *Worker) Out(id string, stream Stream) (string, error) {
+	buf, err := w.log.getOutputBuffer(id, stream)
 	if err != nil {
 		return "", err
 	}
@@ -148,22 +653,101 @@ func (w *Worker) Out(id string) (string, error) {
 	return out, nil
 }
 
-// Kill terminates the process represented by the given id.
-func (w *Worker) Kill(id string) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// ReadOutput returns the part of the given output stream of the process represented
+// by the given id selected by r. Unlike Out, it returns the output exactly as it was
+// written.
+func (w *Worker) ReadOutput(id string, stream Stream, r OutputRange) (OutputChunk, error) {
+	if r.Offset < 0 || r.Length < 0 || r.Tail < 0 {
+		return OutputChunk{}, &ErrInvalidRange{"offset, length and tail must not be negative"}
+	}
 
-	killC, err := w.log.getKillC(id)
+	buf, err := w.log.getOutputBuffer(id, stream)
 	if err != nil {
-		return err
+		return OutputChunk{}, err
 	}
 
-	killC <- true
+	return buf.read(r), nil
+}
+
+// Wait blocks until the process represented by the given id has ended and returns
+// its final status, or returns early with the error of ctx once it is done.
+func (w *Worker) Wait(ctx context.Context, id string) (Status, error) {
+	done, err := w.log.getDone(id)
+	if err != nil {
+		return Status{}, err
+	}
 
 	select {
-	case <-killC:
-		return nil
-	case <-time.After(50 * time.Millisecond):
-		return errors.New("job not killed before timeout")
+	case <-done:
+	case <-ctx.Done():
+		return Status{}, ctx.Err()
+	}
+
+	return w.Status(id)
+}
+
+// Follow writes the given output stream of the process represented by the given id
+// to w as it is produced, starting from the beginning. It returns once the process
+// has ended and all of its output has been written, or when ctx is done.
+func (w *Worker) Follow(ctx context.Context, id string, stream Stream, out io.Writer) error {
+	buf, err := w.log.getOutputBuffer(id, stream)
+	if err != nil {
+		return err
+	}
+
+	var off int64
+	for {
+		data, next, closed, changed := buf.readFrom(off)
+		if len(data) > 0 {
+			_, err = out.Write(data)
+			if err != nil {
+				return err
+			}
+			off = next
+			continue
+		}
+		if closed {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WriteStdin writes everything read from r to the standard input of the process
+// represented by the given id, which must have been started with an open stdin.
+// It returns the number of bytes written.
+func (w *Worker) WriteStdin(id string, r io.Reader) (int64, error) {
+	stdin, err := w.log.getStdin(id)
+	if err != nil {
+		return 0, err
+	}
+
+	return stdin.copyFrom(r)
+}
+
+// CloseStdin closes the standard input of the process represented by the given id,
+// which then reads EOF.
+func (w *Worker) CloseStdin(id string) error {
+	stdin, err := w.log.getStdin(id)
+	if err != nil {
+		return err
+	}
+
+	return stdin.Close()
+}
+
+// Resize sets the window size of the terminal of the process represented by the
+// given id, which must have been started with a terminal.
+func (w *Worker) Resize(id string, rows, cols uint16) error {
+	tty, err := w.log.getTerminal(id)
+	if err != nil {
+		return err
 	}
+
+	return tty.resize(rows, cols)
 }
@@ -0,0 +1,989 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFollow(t *testing.T) {
+	w := NewWorker()
+
+	id, err := w.Run(Job{
+		Command: "sh",
+		Args:    []string{"-c", "echo one; sleep 0.2; echo two; sleep 0.2; echo three"},
+	})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Followers joining at different times must all see the complete output.
+	outputs := make([]bytes.Buffer, 3)
+	var wg sync.WaitGroup
+	for i := range outputs {
+		wg.Add(1)
+		go func(out *bytes.Buffer) {
+			defer wg.Done()
+			err := w.Follow(ctx, id, StreamCombined, out)
+			if err != nil {
+				t.Errorf("Error following job: %v", err)
+			}
+		}(&outputs[i])
+		time.Sleep(150 * time.Millisecond)
+	}
+	wg.Wait()
+
+	want := "one\ntwo\nthree\n"
+	for _, out := range outputs {
+		if got := out.String(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	w := NewWorker()
+
+	id, err := w.Run(Job{
+		Command: "sh",
+		Args:    []string{"-c", "echo out; sleep 0.1; echo err >&2; sleep 0.1; echo out"},
+	})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var tests = []struct {
+		stream Stream
+		want   string
+	}{
+		{stream: StreamStdout, want: "out\nout\n"},
+		{stream: StreamStderr, want: "err\n"},
+		{stream: StreamCombined, want: "out\nerr\nout\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.stream), func(t *testing.T) {
+			var out bytes.Buffer
+			err := w.Follow(ctx, id, test.stream, &out)
+			if err != nil {
+				t.Fatalf("Error following job: %v", err)
+			}
+			if got := out.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	w := NewWorker()
+
+	var tests = []struct {
+		comment  string
+		job      Job
+		state    State
+		exitCode int // Only checked if no signal is expected.
+		signal   string
+		failed   bool
+	}{
+		{
+			comment: "successful process",
+			job:     Job{Command: "true"},
+			state:   StateComplete,
+		},
+		{
+			comment:  "process exiting with an error code",
+			job:      Job{Command: "sh", Args: []string{"-c", "exit 3"}},
+			state:    StateError,
+			exitCode: 3,
+		},
+		{
+			comment: "process terminated by a signal",
+			job:     Job{Command: "sh", Args: []string{"-c", "kill -TERM $$"}},
+			state:   StateError,
+			signal:  "SIGTERM",
+		},
+		{
+			comment: "process that cannot be started",
+			job:     Job{Command: "/nonexistent/command"},
+			state:   StateError,
+			failed:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			id, err := w.Run(test.job)
+			if err != nil {
+				t.Fatalf("Error running job: %v", err)
+			}
+
+			status := waitForJob(t, w, id)
+
+			if status.State != test.state {
+				t.Errorf("got state %q, want %q", status.State, test.state)
+			}
+			if status.Finished == nil {
+				t.Errorf("finish time not set")
+			}
+			if test.failed {
+				if len(status.Error) == 0 {
+					t.Errorf("got no error, want start failure")
+				}
+				return
+			}
+			if status.Started == nil {
+				t.Errorf("start time not set")
+			}
+			if len(test.signal) > 0 {
+				if status.Signal != test.signal {
+					t.Errorf("got signal %q, want %q", status.Signal, test.signal)
+				}
+				return
+			}
+			if status.ExitCode == nil || *status.ExitCode != test.exitCode {
+				t.Errorf("got exit code %v, want %d", status.ExitCode, test.exitCode)
+			}
+		})
+	}
+}
+
+// waitForJob waits for the process represented by the given id to end and returns
+// its final status.
+func waitForJob(t *testing.T, w *Worker, id string) Status {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := w.Follow(ctx, id, StreamCombined, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Error waiting for job: %v", err)
+	}
+
+	status, err := w.Status(id)
+	if err != nil {
+		t.Fatalf("Error getting status: %v", err)
+	}
+
+	return status
+}
+
+func TestTimeout(t *testing.T) {
+	w := NewWorker(WithMaxTimeout(time.Hour), WithKillGrace(100*time.Millisecond))
+
+	// The deadline of the first job must not have passed by the time it runs.
+	soon := time.Now().Add(300 * time.Millisecond)
+	past := time.Now().Add(-time.Second)
+	late := time.Now().Add(2 * time.Hour)
+
+	var tests = []struct {
+		comment string
+		job     Job
+		valid   bool
+		state   State
+	}{
+		{
+			comment: "process exceeding its deadline",
+			job:     Job{Command: "sleep", Args: []string{"10"}, Deadline: &soon},
+			valid:   true,
+			state:   StateTimedOut,
+		},
+		{
+			comment: "process finishing before its timeout",
+			job:     Job{Command: "true", Timeout: time.Minute},
+			valid:   true,
+			state:   StateComplete,
+		},
+		{
+			comment: "process exceeding its timeout",
+			job:     Job{Command: "sleep", Args: []string{"10"}, Timeout: 200 * time.Millisecond},
+			valid:   true,
+			state:   StateTimedOut,
+		},
+		{
+			comment: "timeout above the maximum",
+			job:     Job{Command: "true", Timeout: 2 * time.Hour},
+			valid:   false,
+		},
+		{
+			comment: "deadline beyond the maximum",
+			job:     Job{Command: "true", Deadline: &late},
+			valid:   false,
+		},
+		{
+			comment: "deadline in the past",
+			job:     Job{Command: "true", Deadline: &past},
+			valid:   false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			id, err := w.Run(test.job)
+			if !test.valid {
+				if _, ok := err.(*ErrInvalidJob); !ok {
+					t.Errorf("got %v, want ErrInvalidJob", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error running job: %v", err)
+			}
+
+			status := waitForJob(t, w, id)
+			if status.State != test.state {
+				t.Errorf("got state %q, want %q", status.State, test.state)
+			}
+			if status.Deadline == nil {
+				t.Errorf("deadline not set despite maximum timeout")
+			}
+		})
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	w := NewWorker()
+
+	os.Setenv("WORKER_TEST_INHERITED", "inherited")
+	defer os.Unsetenv("WORKER_TEST_INHERITED")
+
+	dir, err := ioutil.TempDir("", "worker")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `echo "$WORKER_TEST_INHERITED,$WORKER_TEST_SET,$(pwd)"`
+
+	var tests = []struct {
+		comment string
+		job     Job
+		want    string
+	}{
+		{
+			comment: "inherited environment",
+			job:     Job{Env: []string{"WORKER_TEST_SET=set"}},
+			want:    "inherited,set,",
+		},
+		{
+			comment: "clean environment",
+			job:     Job{Env: []string{"WORKER_TEST_SET=set"}, CleanEnv: true},
+			want:    ",set,",
+		},
+		{
+			comment: "working directory",
+			job:     Job{Dir: dir},
+			want:    "inherited,," + dir,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			job := test.job
+			job.Command = "/bin/sh"
+			job.Args = []string{"-c", script}
+
+			id, err := w.Run(job)
+			if err != nil {
+				t.Fatalf("Error running job: %v", err)
+			}
+			waitForJob(t, w, id)
+
+			out, _ := w.Out(id, StreamStdout)
+			got := strings.TrimSpace(out)
+			if test.job.Dir == "" {
+				// Only compare the working directory when it was set.
+				got = got[:strings.LastIndex(got, ",")+1]
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCommandLookup(t *testing.T) {
+	w := NewWorker()
+
+	dir, err := ioutil.TempDir("", "worker")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "script.sh"), []byte("#!/bin/sh\necho script\n"), 0755)
+	if err != nil {
+		t.Fatalf("Error writing script: %v", err)
+	}
+
+	var tests = []struct {
+		comment string
+		job     Job
+	}{
+		{
+			comment: "relative to the working directory",
+			job:     Job{Command: "./script.sh", Dir: dir},
+		},
+		{
+			comment: "on the PATH of the job",
+			job:     Job{Command: "script.sh", Env: []string{"PATH=" + dir}},
+		},
+		{
+			comment: "on a relative PATH of the job",
+			job:     Job{Command: "script.sh", Dir: dir, Env: []string{"PATH=."}, CleanEnv: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			id, err := w.Run(test.job)
+			if err != nil {
+				t.Fatalf("Error running job: %v", err)
+			}
+
+			status := waitForJob(t, w, id)
+			out, _ := w.Out(id, StreamStdout)
+			if status.State != StateComplete || out != "script\n" {
+				t.Errorf("got %s with output %q, want complete with output %q", status, out, "script\n")
+			}
+		})
+	}
+}
+
+func TestUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running processes as another user requires root")
+	}
+
+	w := NewWorker()
+
+	id, err := w.Run(Job{Command: "id", Args: []string{"-u"}, User: "65534"})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	waitForJob(t, w, id)
+
+	out, _ := w.Out(id, StreamStdout)
+	if got := strings.TrimSpace(out); got != "65534" {
+		t.Errorf("got uid %q, want 65534", got)
+	}
+
+	_, err = w.Run(Job{Command: "true", User: "no-such-user"})
+	if _, ok := err.(*ErrInvalidJob); !ok {
+		t.Errorf("got %v for unknown user, want ErrInvalidJob", err)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	w := NewWorker()
+
+	t.Run("payload", func(t *testing.T) {
+		id, err := w.Run(Job{Command: "sort", Stdin: []byte("b\nc\na\n")})
+		if err != nil {
+			t.Fatalf("Error running job: %v", err)
+		}
+		waitForJob(t, w, id)
+
+		out, _ := w.Out(id, StreamStdout)
+		if want := "a\nb\nc\n"; out != want {
+			t.Errorf("got %q, want %q", out, want)
+		}
+	})
+
+	t.Run("open stdin", func(t *testing.T) {
+		id, err := w.Run(Job{Command: "cat", OpenStdin: true})
+		if err != nil {
+			t.Fatalf("Error running job: %v", err)
+		}
+
+		// The pipe is only available once the process has started.
+		for i := 0; i < 50; i++ {
+			_, err = w.WriteStdin(id, strings.NewReader("one\n"))
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("Error writing stdin: %v", err)
+		}
+		_, err = w.WriteStdin(id, strings.NewReader("two\n"))
+		if err != nil {
+			t.Fatalf("Error writing stdin: %v", err)
+		}
+
+		err = w.CloseStdin(id)
+		if err != nil {
+			t.Fatalf("Error closing stdin: %v", err)
+		}
+
+		status := waitForJob(t, w, id)
+		if status.State != StateComplete {
+			t.Errorf("got state %q, want %q", status.State, StateComplete)
+		}
+
+		out, _ := w.Out(id, StreamStdout)
+		if want := "one\ntwo\n"; out != want {
+			t.Errorf("got %q, want %q", out, want)
+		}
+
+		_, err = w.WriteStdin(id, strings.NewReader("three\n"))
+		if _, ok := err.(*ErrStdinClosed); !ok {
+			t.Errorf("got %v writing closed stdin, want ErrStdinClosed", err)
+		}
+	})
+
+	t.Run("idle writer", func(t *testing.T) {
+		id, err := w.Run(Job{Command: "cat", OpenStdin: true})
+		if err != nil {
+			t.Fatalf("Error running job: %v", err)
+		}
+		for i := 0; i < 50; i++ {
+			_, err = w.WriteStdin(id, strings.NewReader(""))
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		// The writer waits for input that only arrives after stdin is closed.
+		r, input := io.Pipe()
+		written := make(chan error)
+		go func() {
+			_, err := w.WriteStdin(id, r)
+			written <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		closed := make(chan error)
+		go func() {
+			closed <- w.CloseStdin(id)
+		}()
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Fatalf("Error closing stdin: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("closing stdin waited for the idle writer")
+		}
+		waitForJob(t, w, id)
+
+		input.Write([]byte("late\n"))
+		err = <-written
+		if _, ok := err.(*ErrStdinClosed); !ok {
+			t.Errorf("got %v writing after stdin was closed, want ErrStdinClosed", err)
+		}
+	})
+}
+
+func TestKillRace(t *testing.T) {
+	w := NewWorker(WithMaxTimeout(time.Hour), WithKillGrace(300*time.Millisecond))
+
+	// The processes ignore SIGTERM, so they are only killed after the grace period.
+	timeout := 100 * time.Millisecond
+	ids := make([]string, 4)
+	for i := range ids {
+		var err error
+		ids[i], err = w.Run(Job{Command: "sh", Args: []string{"-c", "trap '' TERM; sleep 5"}, Timeout: timeout})
+		if err != nil {
+			t.Fatalf("Error running job: %v", err)
+		}
+	}
+	time.Sleep(timeout)
+
+	// Kill each process many times at once as it times out. Only one termination
+	// may take effect, and the others must fail without signalling it again.
+	const kills = 32
+	start := make(chan struct{})
+	errs := make(map[string]chan error, len(ids))
+	for _, id := range ids {
+		errs[id] = make(chan error, kills)
+		for i := 0; i < kills; i++ {
+			go func(id string) {
+				<-start
+				errs[id] <- w.Kill(id, KillOptions{})
+			}(id)
+		}
+	}
+	close(start)
+
+	for _, id := range ids {
+		killed := 0
+		for i := 0; i < kills; i++ {
+			err := <-errs[id]
+			switch err.(type) {
+			case nil:
+				killed++
+			case *ErrJobNotActive:
+			default:
+				t.Errorf("got %v killing the job, want nil or ErrJobNotActive", err)
+			}
+		}
+		if killed > 1 {
+			t.Errorf("job was killed %d times, want at most once", killed)
+		}
+
+		status := waitForJob(t, w, id)
+		if status.State != StateKilled && status.State != StateTimedOut {
+			t.Errorf("got state %q, want %q or %q", status.State, StateKilled, StateTimedOut)
+		}
+		if killed == 1 && status.State != StateKilled {
+			t.Errorf("got state %q after a successful kill, want %q", status.State, StateKilled)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	w := NewWorker(WithKillGrace(300 * time.Millisecond))
+
+	id, err := w.Run(Job{Command: "sleep", Args: []string{"0.2"}})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+
+	err = w.Remove(id)
+	if _, ok := err.(*ErrJobActive); !ok {
+		t.Errorf("got %v removing an active job, want ErrJobActive", err)
+	}
+
+	// A killed process is still running during its grace period.
+	trapped, err := w.Run(Job{Command: "sh", Args: []string{"-c", "trap '' TERM; sleep 5"}})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	go w.Kill(trapped, KillOptions{})
+	time.Sleep(100 * time.Millisecond)
+
+	err = w.Remove(trapped)
+	if _, ok := err.(*ErrJobActive); !ok {
+		t.Errorf("got %v removing a job during its grace period, want ErrJobActive", err)
+	}
+	waitForJob(t, w, trapped)
+
+	waitForJob(t, w, id)
+
+	err = w.Remove(id)
+	if err != nil {
+		t.Fatalf("Error removing job: %v", err)
+	}
+	_, err = w.Status(id)
+	if _, ok := err.(*ErrJobNotFound); !ok {
+		t.Errorf("got %v getting the status of a removed job, want ErrJobNotFound", err)
+	}
+}
+
+// blockingStore is a Store in which saving the status of jobs labelled "slow"
+// blocks until release is closed, as if its disk were slow. Blocked saves are
+// announced on blocked.
+type blockingStore struct {
+	dir     string
+	blocked chan struct{}
+	release chan struct{}
+
+	mu   sync.Mutex
+	slow map[string]bool
+}
+
+func (s *blockingStore) SaveJob(info JobInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.slow[info.ID] = info.Labels["slow"] != ""
+	return nil
+}
+
+func (s *blockingStore) SaveStatus(id string, status Status) error {
+	s.mu.Lock()
+	slow := s.slow[id]
+	s.mu.Unlock()
+
+	if slow {
+		select {
+		case s.blocked <- struct{}{}:
+		default:
+		}
+		<-s.release
+	}
+	return nil
+}
+
+func (s *blockingStore) LoadJobs() ([]JobInfo, error) { return nil, nil }
+func (s *blockingStore) Delete(id string) error       { return nil }
+
+func (s *blockingStore) CreateOutput(id string, stream Stream) (OutputFile, error) {
+	return os.Create(filepath.Join(s.dir, id+"."+string(stream)))
+}
+
+func (s *blockingStore) OpenOutput(id string, stream Stream) (OutputFile, error) {
+	return os.Open(filepath.Join(s.dir, id+"."+string(stream)))
+}
+
+func TestSlowStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &blockingStore{
+		dir:     dir,
+		blocked: make(chan struct{}, 1),
+		release: make(chan struct{}),
+		slow:    make(map[string]bool),
+	}
+	defer close(store.release)
+	w := NewWorker(WithStore(store))
+
+	go w.Run(Job{Command: "true", Labels: map[string]string{"slow": "true"}})
+	<-store.blocked
+
+	// Other jobs run while the status of the first one cannot be saved.
+	done := make(chan Status)
+	go func() {
+		id, err := w.Run(Job{Command: "true"})
+		if err != nil {
+			t.Errorf("Error running job: %v", err)
+			close(done)
+			return
+		}
+		done <- waitForJob(t, w, id)
+	}()
+
+	select {
+	case status := <-done:
+		if status.State != StateComplete {
+			t.Errorf("got state %q, want %q", status.State, StateComplete)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job held up by saving the status of another")
+	}
+}
+
+func TestList(t *testing.T) {
+	w := NewWorker()
+
+	var ids []string
+	for _, job := range []Job{
+		{Command: "echo", Labels: map[string]string{"env": "prod"}},
+		{Command: "/bin/echo", Labels: map[string]string{"env": "dev"}},
+		{Command: "true"},
+		{Command: "false", Labels: map[string]string{"env": "prod", "team": "a"}},
+	} {
+		id, err := w.Run(job)
+		if err != nil {
+			t.Fatalf("Error running job: %v", err)
+		}
+		waitForJob(t, w, id)
+		ids = append(ids, id)
+	}
+
+	var tests = []struct {
+		comment string
+		opts    ListOptions
+		want    []string
+	}{
+		{
+			comment: "all jobs, newest first",
+			want:    []string{ids[3], ids[2], ids[1], ids[0]},
+		},
+		{
+			comment: "by state",
+			opts:    ListOptions{State: StateError},
+			want:    []string{ids[3]},
+		},
+		{
+			comment: "by command base name",
+			opts:    ListOptions{Command: "echo"},
+			want:    []string{ids[1], ids[0]},
+		},
+		{
+			comment: "by label value",
+			opts:    ListOptions{Labels: []string{"env=prod"}},
+			want:    []string{ids[3], ids[0]},
+		},
+		{
+			comment: "by several labels",
+			opts:    ListOptions{Labels: []string{"env=prod", "team"}},
+			want:    []string{ids[3]},
+		},
+		{
+			comment: "allowed jobs only",
+			opts:    ListOptions{Allow: func(id string) bool { return id != ids[2] }},
+			want:    []string{ids[3], ids[1], ids[0]},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			list, err := w.List(test.opts)
+			if err != nil {
+				t.Fatalf("Error listing jobs: %v", err)
+			}
+			var got []string
+			for _, job := range list.Jobs {
+				got = append(got, job.ID)
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Pages of two jobs cover every job exactly once.
+	var got []string
+	opts := ListOptions{Limit: 2}
+	for page := 0; ; page++ {
+		if page > len(ids) {
+			t.Fatalf("listing did not end")
+		}
+		list, err := w.List(opts)
+		if err != nil {
+			t.Fatalf("Error listing jobs: %v", err)
+		}
+		for _, job := range list.Jobs {
+			got = append(got, job.ID)
+		}
+		if len(list.Next) == 0 {
+			break
+		}
+		opts.Cursor = list.Next
+	}
+	want := []string{ids[3], ids[2], ids[1], ids[0]}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v across pages, want %v", got, want)
+	}
+
+	_, err := w.List(ListOptions{Cursor: "not a cursor"})
+	if _, ok := err.(*ErrInvalidCursor); !ok {
+		t.Errorf("got %v for an invalid cursor, want ErrInvalidCursor", err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	w := NewWorker(WithConcurrency(1, 0))
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := w.Run(Job{Command: "sleep", Args: []string{"0.2"}})
+		if err != nil {
+			t.Fatalf("Error running job: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	for i, id := range ids[1:] {
+		status, err := w.Status(id)
+		if err != nil || status.State != StateQueued || status.QueuePosition != i+1 {
+			t.Errorf("got status %v (%v) for job %d, want %s at position %d", status, err, i+1, StateQueued, i+1)
+		}
+	}
+
+	err := w.Kill(ids[2], KillOptions{})
+	if err != nil {
+		t.Fatalf("Error killing queued job: %v", err)
+	}
+	status, _ := w.Status(ids[2])
+	if status.State != StateKilled || status.Started != nil {
+		t.Errorf("got status %v for a killed queued job, want %s without starting", status, StateKilled)
+	}
+
+	first := waitForJob(t, w, ids[0])
+	second := waitForJob(t, w, ids[1])
+	if second.State != StateComplete || second.Started.Before(*first.Finished) {
+		t.Errorf("queued job %v started at %v, before the running job finished at %v", second, second.Started, first.Finished)
+	}
+}
+
+func TestQueueKillRace(t *testing.T) {
+	w := NewWorker(WithConcurrency(1, 0))
+
+	ids := make([]string, 16)
+	for i := range ids {
+		var err error
+		ids[i], err = w.Run(Job{Command: "sleep", Args: []string{"5"}})
+		if err != nil {
+			t.Fatalf("Error running job: %v", err)
+		}
+	}
+
+	// Kill every job at once, so that queued jobs are admitted as they are killed.
+	// None of them ends on its own, so every kill must succeed.
+	errs := make(chan error, len(ids))
+	for _, id := range ids {
+		go func(id string) {
+			errs <- w.Kill(id, KillOptions{})
+		}(id)
+	}
+	for range ids {
+		if err := <-errs; err != nil {
+			t.Errorf("Error killing job: %v", err)
+		}
+	}
+
+	for _, id := range ids {
+		status := waitForJob(t, w, id)
+		if status.State != StateKilled {
+			t.Errorf("got state %q, want %q", status.State, StateKilled)
+		}
+	}
+}
+
+func TestQueuePerUser(t *testing.T) {
+	w := NewWorker(WithConcurrency(0, 1))
+
+	run := func(owner string) string {
+		id, err := w.Run(Job{Command: "sleep", Args: []string{"0.2"}, Owner: owner})
+		if err != nil {
+			t.Fatalf("Error running job: %v", err)
+		}
+		return id
+	}
+	first, second, other := run("alice"), run("alice"), run("bob")
+
+	for _, test := range []struct {
+		id   string
+		want State
+	}{
+		{first, StateActive},
+		{second, StateQueued},
+		{other, StateActive},
+	} {
+		status, err := w.Status(test.id)
+		if err != nil || status.State != test.want {
+			t.Errorf("got status %v (%v), want %s", status, err, test.want)
+		}
+	}
+
+	waitForJob(t, w, second)
+	waitForJob(t, w, other)
+}
+
+func TestQueueOrder(t *testing.T) {
+	var tests = []struct {
+		comment string
+		weights map[string]int
+		jobs    []Job
+		want    []string // Owners and priorities of the jobs, in expected order.
+	}{
+		{
+			comment: "round-robin between users, by priority for each user",
+			jobs: []Job{
+				{Owner: "alice"},
+				{Owner: "alice"},
+				{Owner: "alice", Priority: 5},
+				{Owner: "bob"},
+				{Owner: "bob", Priority: -1},
+			},
+			want: []string{"bob:0", "alice:5", "bob:-1", "alice:0", "alice:0"},
+		},
+		{
+			comment: "weighted users",
+			weights: map[string]int{"alice": 2},
+			jobs: []Job{
+				{Owner: "alice"},
+				{Owner: "alice"},
+				{Owner: "alice"},
+				{Owner: "alice"},
+				{Owner: "bob"},
+				{Owner: "bob"},
+			},
+			// Alice has had one turn, for the running job, and has two for every one
+			// of Bob's.
+			want: []string{"bob:0", "alice:0", "alice:0", "bob:0", "alice:0", "alice:0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			w := NewWorker(WithConcurrency(1, 0), WithUserWeights(test.weights))
+
+			// Alice's first job runs while the others are queued.
+			blocker, err := w.Run(Job{Command: "sleep", Args: []string{"0.2"}, Owner: "alice"})
+			if err != nil {
+				t.Fatalf("Error running job: %v", err)
+			}
+			for _, job := range test.jobs {
+				job.Command = "true"
+				_, err := w.Run(job)
+				if err != nil {
+					t.Fatalf("Error running job: %v", err)
+				}
+			}
+
+			queued := w.Queue()
+			var got []string
+			for _, job := range queued {
+				got = append(got, fmt.Sprintf("%s:%d", job.Owner, job.Priority))
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got queue %v, want %v", got, test.want)
+			}
+
+			// The jobs start in the order of the queue.
+			waitForJob(t, w, blocker)
+			var previous time.Time
+			for _, job := range queued {
+				status := waitForJob(t, w, job.ID)
+				if status.Started == nil || status.Started.Before(previous) {
+					t.Errorf("job at position %d started at %v, before the previous one at %v", job.Position, status.Started, previous)
+					continue
+				}
+				previous = *status.Started
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	w := NewWorker(WithConcurrency(1, 0))
+
+	running, err := w.Run(Job{Command: "sh", Args: []string{"-c", "sleep 0.2; exit 3"}})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	queued, err := w.Run(Job{Command: "true"})
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = w.Wait(ctx, running)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v waiting past the context deadline, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A queued job ends when it is killed.
+	go w.Kill(queued, KillOptions{})
+	status, err := w.Wait(context.Background(), queued)
+	if err != nil || status.State != StateKilled {
+		t.Errorf("got status %v (%v) for a killed queued job, want %s", status, err, StateKilled)
+	}
+
+	status, err = w.Wait(context.Background(), running)
+	if err != nil || status.State != StateError || status.ExitCode == nil || *status.ExitCode != 3 {
+		t.Errorf("got status %v (%v), want %s with exit code 3", status, err, StateError)
+	}
+
+	_, err = w.Wait(context.Background(), "missing")
+	if _, ok := err.(*ErrJobNotFound); !ok {
+		t.Errorf("got %v waiting for a missing job, want ErrJobNotFound", err)
+	}
+}